@@ -5,8 +5,8 @@ import (
 	"log"
 	"net"
 	"os"
+	"time"
 
-	"github.com/matchaxnb/gokrb5/v8/client"
 	"github.com/matchaxnb/spnegoproxy/spnegoproxy"
 )
 
@@ -19,27 +19,119 @@ func main() {
 	realm := flag.String("realm", "YOUR.REALM", "realm")
 	consulAddress := flag.String("consul-address", "your.consul.host:8500", "consul server address")
 	consulToken := flag.String("consul-token", "", "consul access token (optional)")
+	consulAgentAddress := flag.String("consul-agent-address", "", "address of the local consul agent this proxy is registered with, CONSUL_HTTP_ADDR or 127.0.0.1:8500 when empty")
 	proxy := flag.String("proxy-service", "your-service-to-proxy", "proxy consul service")
 	spnServiceType := flag.String("spn-service-type", "HTTP", "SPN service type")
+	lbStrategy := flag.String("lb-strategy", "round-robin", "how to spread clients over backends: round-robin, least-connections, random or ip-hash")
+	mutualAuth := flag.Bool("mutual-auth", false, "check the SPNEGO token backends answer with, failing requests to backends that cannot prove their identity (every request then does SPNEGO, without hadoop.auth cookies or delegation tokens)")
+	delegationTokens := flag.Bool("delegation-tokens", false, "authenticate requests with an HDFS delegation token the proxy gets and renews, instead of SPNEGO (needs -datanode-redirects follow or rewrite)")
+	delegationRenewer := flag.String("delegation-token-renewer", "", "renewer of the delegation token, the short name of the proxy principal when empty")
 	keytabFile := flag.String("keytab-file", "krb5.keytab", "keytab file path")
+	ccache := flag.String("ccache", "", "credential cache to take the TGT from instead of logging in with -keytab-file, KRB5CCNAME when given empty or when -keytab-file is empty")
+	passwordFile := flag.String("password-file", "", "file holding the password to log in with instead of -keytab-file")
+	passwordEnv := flag.String("password-env", "", "environment variable holding the password to log in with instead of -keytab-file")
 	properUsername := flag.String("proper-username", "", "for WebHDFS, user.name value to force-set")
 	dropUsername := flag.Bool("drop-username", false, "drop user.name from all queries")
+	dataNodeRedirects := flag.String("datanode-redirects", "passthrough", "what to do with WebHDFS redirects to DataNodes: passthrough, follow or rewrite")
+	tlsCert := flag.String("tls-cert", "", "PEM certificate to serve TLS with, plain HTTP is served when empty")
+	tlsKey := flag.String("tls-key", "", "PEM private key of -tls-cert")
+	tlsMinVersion := flag.String("tls-min-version", "1.2", "minimum TLS version accepted from clients: 1.0, 1.1, 1.2 or 1.3")
+	tlsCiphers := flag.String("tls-ciphers", "", "comma separated TLS 1.2 cipher suites accepted from clients (optional)")
+	tlsClientCA := flag.String("tls-client-ca", "", "PEM bundle of CAs to verify client certificates with (optional)")
+	tlsClientAuth := flag.String("tls-client-auth", "require", "with -tls-client-ca, whether client certificates are required or optional")
+	impersonation := flag.String("impersonation", "none", "how backends see the end user instead of the proxy principal: none, s4u or doas")
+	identityFromCert := flag.Bool("identity-from-cert", false, "take the end user from the CN of the verified client certificate")
+	identityHeader := flag.String("identity-header", "", "header an ingress puts the end user name in (optional)")
+	identityTrustedFrom := flag.String("identity-header-trusted-from", "", "comma separated CIDRs -identity-header is believed from, any client when empty (refused with -impersonation)")
+	apiKeyHeader := flag.String("api-key-header", "X-Api-Key", "header clients send their API key in, with -api-keys-file")
+	apiKeysFile := flag.String("api-keys-file", "", "JSON object mapping API keys to end user names (optional)")
+	upstreamTLS := flag.Bool("upstream-tls", false, "talk HTTPS to the backends (swebhdfs)")
+	upstreamCA := flag.String("upstream-ca", "", "PEM bundle of CAs to verify backend certificates with, system roots when empty")
+	upstreamCert := flag.String("upstream-cert", "", "PEM client certificate presented to the backends (optional)")
+	upstreamKey := flag.String("upstream-key", "", "PEM private key of -upstream-cert")
+	upstreamInsecure := flag.Bool("upstream-insecure-skip-verify", false, "do not verify backend certificates (labs only)")
+	chroot := flag.String("chroot", "", "HDFS directory clients see as / and cannot leave (optional)")
+	readOnly := flag.Bool("read-only", false, "refuse every WebHDFS operation that is not a known read")
+	breakerFailures := flag.Int("breaker-failures", spnegoproxy.DEFAULT_BREAKER_FAILURE_THRESHOLD, "consecutive failures of a backend opening its circuit, no circuit breaker when 0")
+	breakerCoolDown := flag.Duration("breaker-cool-down", spnegoproxy.DEFAULT_BREAKER_COOL_DOWN, "how long an open circuit refuses requests before probing the backend again")
+	breakerProbes := flag.Int("breaker-half-open-probes", 1, "requests let through at once to probe a backend whose circuit is half-open")
+	healthCheck := flag.String("health-check", "none", "how backends are probed: none, webhdfs or tcp")
+	healthCheckPath := flag.String("health-check-path", "/", "HDFS path of webhdfs probes")
+	healthCheckOp := flag.String("health-check-op", "GETFILESTATUS", "WebHDFS GET operation of webhdfs probes")
+	healthCheckInterval := flag.Duration("health-check-interval", 10*time.Second, "time between two probes of a backend")
+	healthCheckTimeout := flag.Duration("health-check-timeout", 5*time.Second, "time a probe may take")
+	healthCheckRise := flag.Int("health-check-rise", 2, "consecutive successful probes bringing a backend back")
+	healthCheckFall := flag.Int("health-check-fall", 3, "consecutive failed probes taking a backend out")
+	maxConns := flag.Int("max-connections", 0, "client connections open at once, unlimited when 0")
+	maxInFlight := flag.Int("max-inflight", 0, "requests sent to the backends at once, unlimited when 0")
+	maxQueue := flag.Int("max-queue", 100, "with -max-inflight, requests waiting for their turn before the next get a 503")
+	queueTimeout := flag.Duration("queue-timeout", 30*time.Second, "with -max-inflight, how long a request waits for its turn")
+	rateLimits := flag.String("rate-limit", "", "requests per second allowed to each client per operation class, as in metadata=100:200,data=20,mutating=5 (optional)")
+	rateLimitKey := flag.String("rate-limit-key", "ip", "what tells clients apart for -rate-limit: ip or identity")
+	policyFile := flag.String("policy-file", "", "JSON policy allowing or denying requests, reloaded when it changes (optional)")
+	consulServiceID := flag.String("consul-service-id", "", "consul service instance of this proxy, deregistered from the agent at -consul-agent-address on SIGTERM before draining (optional)")
+	drainTimeout := flag.Duration("drain-timeout", spnegoproxy.DEFAULT_DRAIN_TIMEOUT, "on SIGTERM, how long active requests get to finish before exiting")
 	metricsAddrS := flag.String("metrics-addr", "", "optional address to expose a prometheus metrics endpoint")
 	debug := flag.Bool("debug", true, "turn on debugging")
 	flag.Parse()
-	keytab, conf := spnegoproxy.LoadKrb5Config(keytabFile, cfgFile)
+	strategy, err := spnegoproxy.ParseBalancingStrategy(*lbStrategy)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	redirectMode, err := spnegoproxy.ParseRedirectMode(*dataNodeRedirects)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	healthCheckMode, err := spnegoproxy.ParseHealthCheckMode(*healthCheck)
+	if err != nil {
+		logger.Fatal(err)
+	}
+	impersonationMode, err := spnegoproxy.ParseImpersonationMode(*impersonation)
+	if err != nil {
+		logger.Fatal(err)
+	}
 
 	consulClient := spnegoproxy.BuildConsulClient(consulAddress, consulToken)
 	realHosts := spnegoproxy.StartConsulGetService(consulClient, *proxy)
-	kclient := client.NewWithKeytab(*user, *realm, keytab, conf, client.Logger(logger), client.DisablePAFXFAST(false))
-	kclient.Login()
-	spnegoClient, spnEnabled, realHost, err := spnegoproxy.BuildSPNClient(realHosts, kclient, *spnServiceType)
+	var credManager *spnegoproxy.CredentialManager
+	ccacheGiven := false
+	flag.Visit(func(f *flag.Flag) { ccacheGiven = ccacheGiven || f.Name == "ccache" })
+	// an ambient KRB5CCNAME must not take over from a keytab, it is only used when asked for
+	if len(*ccache) == 0 && (ccacheGiven || len(*keytabFile) == 0 && len(*passwordFile) == 0 && len(*passwordEnv) == 0) {
+		*ccache = os.Getenv("KRB5CCNAME")
+	}
+	if len(*ccache) > 0 {
+		credManager, err = spnegoproxy.NewCCacheCredentialManager(*ccache, *cfgFile)
+	} else if len(*passwordFile) > 0 || len(*passwordEnv) > 0 {
+		credManager, err = spnegoproxy.NewPasswordCredentialManager(*user, *realm, *passwordFile, *passwordEnv, *cfgFile)
+	} else {
+		credManager, err = spnegoproxy.NewKeytabCredentialManager(*user, *realm, *keytabFile, *cfgFile)
+	}
 	if err != nil {
-		logger.Panic("Cannot get SPN for service, failing")
+		logger.Panicf("Cannot log in: %s", err)
 	}
-	_, _, err = kclient.GetServiceTicket(spnEnabled)
+	go credManager.Run(nil)
+	kclient := credManager.Client()
+	spnRegistry := spnegoproxy.NewSPNEGOClientRegistry(kclient, *spnServiceType)
+	credManager.OnClientChange(spnRegistry.SetKrbClient)
+	if *mutualAuth {
+		spnRegistry.RequireMutualAuth()
+	}
+	backendPool, err := spnegoproxy.BuildBackendPool(realHosts, spnRegistry, strategy)
 	if err != nil {
-		log.Panic("Cannot get service ticket, probably wrong config", err)
+		logger.Panic("Cannot get SPN for service, failing")
+	}
+	backendPool.SetCircuitBreaker(spnegoproxy.BreakerSettings{
+		FailureThreshold: *breakerFailures,
+		CoolDown:         *breakerCoolDown,
+		HalfOpenProbes:   *breakerProbes,
+	})
+	go backendPool.Watch(realHosts)
+	// one instance with a broken SPN must not keep the proxy from serving the others
+	for _, backend := range backendPool.Backends() {
+		if _, _, err := kclient.GetServiceTicket(backend.SPN); err != nil {
+			logger.Printf("Cannot get service ticket for %s (%s), probably wrong config: %s", backend.Address(), backend.SPN, err)
+		}
 	}
 	if *debug {
 		logger.Printf("Listening on %s\n", *addr)
@@ -62,19 +154,96 @@ func main() {
 		logger.Panic(err)
 	}
 
+	if *readOnly {
+		spnegoproxy.EnableReadOnly()
+	}
+	if len(*policyFile) > 0 {
+		if err := spnegoproxy.EnablePolicy(*policyFile, *debug); err != nil {
+			logger.Fatal(err)
+		}
+	}
+	if len(*rateLimits) > 0 {
+		if err := spnegoproxy.EnableRateLimiting(*rateLimits, *rateLimitKey); err != nil {
+			logger.Fatal(err)
+		}
+	}
 	if *dropUsername {
 		spnegoproxy.DropUsername(*debug)
 	} else if len(*properUsername) > 0 {
 		spnegoproxy.EnforceUserName(*properUsername, *debug)
 	}
 
-	errorCount := 0
-	defer connListener.Close()
-	for {
-		conn, err := connListener.AcceptTCP()
+	proxyHandler := spnegoproxy.NewProxyHandler(backendPool, *debug)
+	proxyHandler.SetRedirectMode(redirectMode)
+	proxyHandler.SetConcurrencyLimit(*maxInFlight, *maxQueue, *queueTimeout)
+	if len(*chroot) > 0 {
+		if err := proxyHandler.SetChroot(*chroot); err != nil {
+			logger.Fatal(err)
+		}
+	}
+	if *upstreamTLS {
+		upstreamTLSConfig, err := spnegoproxy.BuildUpstreamTLSConfig(spnegoproxy.UpstreamTLSOptions{
+			CAFile:             *upstreamCA,
+			CertFile:           *upstreamCert,
+			KeyFile:            *upstreamKey,
+			InsecureSkipVerify: *upstreamInsecure,
+		})
 		if err != nil {
-			logger.Panic(err)
+			logger.Fatal(err)
+		}
+		proxyHandler.SetUpstreamTLS(upstreamTLSConfig)
+	}
+	if *identityFromCert || len(*identityHeader) > 0 || len(*apiKeysFile) > 0 {
+		resolver, err := spnegoproxy.NewIdentityResolver(*identityFromCert, *identityHeader, *identityTrustedFrom)
+		if err != nil {
+			logger.Fatal(err)
+		}
+		if len(*apiKeysFile) > 0 {
+			if err := resolver.SetAPIKeys(*apiKeyHeader, *apiKeysFile); err != nil {
+				logger.Fatal(err)
+			}
 		}
-		go spnegoproxy.HandleClient(conn, realHost, spnegoClient, *debug, &errorCount)
+		proxyHandler.SetIdentityResolver(resolver)
+	}
+	if err := proxyHandler.SetImpersonation(impersonationMode); err != nil {
+		logger.Fatal(err)
+	}
+	err = proxyHandler.EnableHealthChecks(spnegoproxy.HealthCheckSettings{
+		Mode:     healthCheckMode,
+		Path:     *healthCheckPath,
+		Op:       *healthCheckOp,
+		Interval: *healthCheckInterval,
+		Timeout:  *healthCheckTimeout,
+		Rise:     *healthCheckRise,
+		Fall:     *healthCheckFall,
+	})
+	if err != nil {
+		logger.Fatal(err)
+	}
+	if *delegationTokens {
+		if err := proxyHandler.EnableDelegationTokens(*delegationRenewer); err != nil {
+			logger.Fatal(err)
+		}
+	}
+	listener, err := spnegoproxy.WrapTLSListener(spnegoproxy.LimitListener(connListener, *maxConns), spnegoproxy.ServerTLSOptions{
+		CertFile:     *tlsCert,
+		KeyFile:      *tlsKey,
+		ClientCAFile: *tlsClientCA,
+		ClientAuth:   *tlsClientAuth,
+		MinVersion:   *tlsMinVersion,
+		CipherSuites: *tlsCiphers,
+	})
+	if err != nil {
+		logger.Fatal(err)
+	}
+	server := spnegoproxy.NewProxyServer(proxyHandler)
+	var beforeDrain []func() error
+	if len(*consulServiceID) > 0 {
+		// -consul-address may well be a server, which knows nothing of the services agents registered
+		agentClient := spnegoproxy.BuildConsulAgentClient(consulAgentAddress, consulToken)
+		beforeDrain = append(beforeDrain, func() error {
+			return spnegoproxy.DeregisterConsulService(agentClient, *consulServiceID)
+		})
 	}
+	os.Exit(spnegoproxy.ServeUntilSignal(server, listener, *drainTimeout, beforeDrain...))
 }
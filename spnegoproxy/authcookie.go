@@ -0,0 +1,157 @@
+package spnegoproxy
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// the cookie Hadoop's AuthenticationFilter hands out once SPNEGO succeeded
+const AUTH_COOKIE_NAME = "hadoop.auth"
+
+// cookies that expire sooner than this are not used anymore, SPNEGO happens again instead
+const AUTH_COOKIE_EXPIRY_MARGIN = time.Second * 30
+
+type authCookie struct {
+	value   string
+	quoted  bool
+	expires time.Time
+}
+
+// authCookieJar keeps the hadoop.auth cookie of each backend, and of each end user with S4U, so that we only need SPNEGO when it is
+// missing, expires or gets refused
+type authCookieJar struct {
+	mu       sync.Mutex
+	cookies  map[string]authCookie
+	used     atomic.Uint64
+	rejected atomic.Uint64
+}
+
+func (j *authCookieJar) get(key string) (authCookie, bool) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	c, ok := j.cookies[key]
+	if ok && time.Until(c.expires) < AUTH_COOKIE_EXPIRY_MARGIN {
+		delete(j.cookies, key)
+		return c, false
+	}
+	return c, ok
+}
+
+func (j *authCookieJar) drop(key string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	delete(j.cookies, key)
+}
+
+// store keeps the hadoop.auth cookie res sets, if any
+func (j *authCookieJar) store(key string, res *http.Response) {
+	for _, c := range res.Cookies() {
+		if c.Name != AUTH_COOKIE_NAME {
+			continue
+		}
+		if c.Value == "" || c.MaxAge < 0 {
+			// the backend clears the cookie when authentication failed
+			j.drop(key)
+			continue
+		}
+		expires, ok := authCookieExpiry(c.Value)
+		if !ok {
+			if c.Expires.IsZero() {
+				continue
+			}
+			expires = c.Expires
+		}
+		j.mu.Lock()
+		if j.cookies == nil {
+			j.cookies = make(map[string]authCookie)
+		}
+		j.cookies[key] = authCookie{value: c.Value, quoted: c.Quoted, expires: expires}
+		j.mu.Unlock()
+	}
+}
+
+func (j *authCookieJar) metrics() string {
+	j.mu.Lock()
+	cached := len(j.cookies)
+	j.mu.Unlock()
+	return fmt.Sprintf("proxy_auth_cookies_cached %d\n", cached) +
+		fmt.Sprintf("proxy_auth_cookie_requests_total %d\n", j.used.Load()) +
+		fmt.Sprintf("proxy_auth_cookie_rejected_total %d\n", j.rejected.Load())
+}
+
+// authCookieExpiry reads the expiry the signed token carries, as in u=...&p=...&t=...&e=<ms>&s=...
+func authCookieExpiry(value string) (time.Time, bool) {
+	for _, field := range strings.Split(value, "&") {
+		if ms, ok := strings.CutPrefix(field, "e="); ok {
+			n, err := strconv.ParseInt(ms, 10, 64)
+			if err != nil {
+				return time.Time{}, false
+			}
+			return time.UnixMilli(n), true
+		}
+	}
+	return time.Time{}, false
+}
+
+// dropAuthCookie removes a hadoop.auth cookie sent by the client, only the proxy authenticates to backends
+func dropAuthCookie(req *http.Request) {
+	cookies := req.Cookies()
+	found := false
+	for _, c := range cookies {
+		found = found || c.Name == AUTH_COOKIE_NAME
+	}
+	if !found {
+		return
+	}
+	req.Header.Del("Cookie")
+	for _, c := range cookies {
+		if c.Name != AUTH_COOKIE_NAME {
+			req.AddCookie(c)
+		}
+	}
+}
+
+// replayable tells whether req can be sent a second time, which is only the case without a body
+// as proxied bodies are streamed
+func replayable(req *http.Request) bool {
+	return req.Body == nil || req.Body == http.NoBody
+}
+
+// roundTripWithCookie sends req with the cached hadoop.auth cookie stored under key. It returns a nil response
+// when there is no usable cookie or when the backend refused it and req can be sent again with SPNEGO.
+func (t *spnegoTransport) roundTripWithCookie(req *http.Request, key string) (*http.Response, error) {
+	jar := &t.handler.authCookies
+	cookie, ok := jar.get(key)
+	if !ok {
+		return nil, nil
+	}
+	cookieReq := req.Clone(req.Context())
+	cookieReq.AddCookie(&http.Cookie{Name: AUTH_COOKIE_NAME, Value: cookie.value, Quoted: cookie.quoted})
+	jar.used.Add(1)
+	res, err := t.next.RoundTrip(cookieReq)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusUnauthorized {
+		jar.store(key, res)
+		return res, nil
+	}
+	jar.rejected.Add(1)
+	jar.drop(key)
+	if t.handler.debug {
+		logger.Printf("%s refused our %s cookie", req.URL.Host, AUTH_COOKIE_NAME)
+	}
+	if !replayable(req) {
+		// the body is gone, let the client try again
+		return res, nil
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	return nil, nil
+}
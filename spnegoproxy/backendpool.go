@@ -0,0 +1,218 @@
+package spnegoproxy
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand/v2"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// BalancingStrategy decides which backend of a pool gets a new client request
+type BalancingStrategy string
+
+const (
+	RoundRobin       BalancingStrategy = "round-robin"
+	LeastConnections BalancingStrategy = "least-connections"
+	RandomBackend    BalancingStrategy = "random"
+	ClientIPHash     BalancingStrategy = "ip-hash"
+)
+
+// ErrNoBackend is what Pick returns when the pool is empty or none of its backends takes requests, as they
+// are failing their health checks or their circuit is open
+var ErrNoBackend = errors.New("no backend is available")
+
+func ParseBalancingStrategy(s string) (BalancingStrategy, error) {
+	switch strategy := BalancingStrategy(strings.ToLower(s)); strategy {
+	case RoundRobin, LeastConnections, RandomBackend, ClientIPHash:
+		return strategy, nil
+	default:
+		return "", fmt.Errorf("unknown balancing strategy %q (want one of %s, %s, %s, %s)", s, RoundRobin, LeastConnections, RandomBackend, ClientIPHash)
+	}
+}
+
+// Backend is one upstream host with its own SPN
+type Backend struct {
+	HostPort
+	SPN      string
+	dataNode bool
+	active   atomic.Int64
+	total    atomic.Uint64
+	breaker  *circuitBreaker
+	health   backendHealth
+}
+
+func (b *Backend) Address() string {
+	return b.f()
+}
+
+// Acquire marks a client request as in flight on this backend
+func (b *Backend) Acquire() {
+	b.active.Add(1)
+	b.total.Add(1)
+}
+
+// Release must be called once for every Acquire
+func (b *Backend) Release() {
+	b.active.Add(-1)
+}
+
+func (b *Backend) ActiveRequests() int64 {
+	return b.active.Load()
+}
+
+// BackendPool holds every backend we may proxy to and picks one per client request
+type BackendPool struct {
+	mu       sync.RWMutex
+	backends []*Backend
+	strategy BalancingStrategy
+	registry *SPNEGOClientRegistry
+	next     atomic.Uint64
+	// nil when backends have no circuit breaker
+	breakerSettings *BreakerSettings
+	healthChecked   atomic.Bool
+}
+
+// NewBackendPool creates an empty pool. When registry is nil, backends get no SPNEGO client.
+func NewBackendPool(strategy BalancingStrategy, registry *SPNEGOClientRegistry) *BackendPool {
+	pool := &BackendPool{
+		strategy: strategy,
+		registry: registry,
+	}
+	registerMetricsSource(pool.metrics)
+	return pool
+}
+
+// BuildBackendPool waits for the first list of valid hosts and builds a pool out of it
+func BuildBackendPool(validHosts chan []HostPort, registry *SPNEGOClientRegistry, strategy BalancingStrategy) (*BackendPool, error) {
+	logger.Print("Building a backend pool")
+	pool := NewBackendPool(strategy, registry)
+	pool.Update(<-validHosts)
+	if len(pool.Backends()) == 0 {
+		return pool, ErrNoBackend
+	}
+	return pool, nil
+}
+
+func (p *BackendPool) newBackend(hp HostPort) *Backend {
+	b := &Backend{HostPort: hp, breaker: p.newBreaker(hp.f())}
+	if p.registry != nil {
+		b.SPN = p.registry.SPNForHost(hp.Host)
+	}
+	return b
+}
+
+// Update replaces the pool members, keeping the state of the backends that are still there
+func (p *BackendPool) Update(hosts []HostPort) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	known := make(map[string]*Backend, len(p.backends))
+	for _, b := range p.backends {
+		known[b.Address()] = b
+	}
+	backends := make([]*Backend, 0, len(hosts))
+	for _, hp := range hosts {
+		if b, ok := known[hp.f()]; ok {
+			backends = append(backends, b)
+			delete(known, hp.f())
+			continue
+		}
+		logger.Printf("Adding backend %s", hp.f())
+		backends = append(backends, p.newBackend(hp))
+	}
+	for addr, b := range known {
+		// requests already on the backend keep their reference and finish normally
+		logger.Printf("Removing backend %s, draining %d active requests", addr, b.ActiveRequests())
+	}
+	p.backends = backends
+}
+
+// Watch applies every list of valid hosts received on validHosts to the pool, until the channel is closed
+func (p *BackendPool) Watch(validHosts <-chan []HostPort) {
+	for hosts := range validHosts {
+		p.Update(hosts)
+	}
+}
+
+// Backends returns a snapshot of the current pool members
+func (p *BackendPool) Backends() []*Backend {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return append([]*Backend(nil), p.backends...)
+}
+
+// Pick chooses a backend for a client according to the pool strategy
+func (p *BackendPool) Pick(clientAddr string) (*Backend, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if len(p.backends) == 0 {
+		return nil, ErrNoBackend
+	}
+	backends := make([]*Backend, 0, len(p.backends))
+	for _, b := range p.backends {
+		if b.breaker.ready() && !b.health.down.Load() {
+			backends = append(backends, b)
+		}
+	}
+	if len(backends) == 0 {
+		return nil, ErrNoBackend
+	}
+	switch p.strategy {
+	case LeastConnections:
+		best := backends[0]
+		for _, b := range backends[1:] {
+			if b.ActiveRequests() < best.ActiveRequests() {
+				best = b
+			}
+		}
+		return best, nil
+	case RandomBackend:
+		return backends[rand.IntN(len(backends))], nil
+	case ClientIPHash:
+		return pickByClientIP(backends, clientAddr), nil
+	default:
+		n := p.next.Add(1) - 1
+		return backends[n%uint64(len(backends))], nil
+	}
+}
+
+// pickByClientIP uses rendezvous hashing so that a membership change only moves
+// the clients of the backends that came or went
+func pickByClientIP(backends []*Backend, clientAddr string) *Backend {
+	ip := clientAddr
+	if host, _, err := net.SplitHostPort(clientAddr); err == nil {
+		ip = host
+	}
+	var best *Backend
+	var bestScore uint64
+	for _, b := range backends {
+		h := fnv.New64a()
+		h.Write([]byte(ip))
+		h.Write([]byte{0})
+		h.Write([]byte(b.Address()))
+		if score := h.Sum64(); best == nil || score > bestScore {
+			best, bestScore = b, score
+		}
+	}
+	return best
+}
+
+func (p *BackendPool) metrics() string {
+	var sb strings.Builder
+	backends := p.Backends()
+	sb.WriteString(fmt.Sprintf("proxy_backends_available %d\n", len(backends)))
+	for _, b := range backends {
+		sb.WriteString(fmt.Sprintf("proxy_backend_active_requests{backend=%q} %d\n", b.Address(), b.ActiveRequests()))
+		sb.WriteString(fmt.Sprintf("proxy_backend_requests_total{backend=%q} %d\n", b.Address(), b.total.Load()))
+		if b.breaker != nil {
+			sb.WriteString(b.breaker.metrics())
+		}
+		if p.healthChecked.Load() {
+			sb.WriteString(b.health.metrics(b.Address()))
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,175 @@
+package spnegoproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// JSON fields of WebHDFS answers holding an absolute HDFS path
+var jailedJSONFields = map[string]bool{
+	"Path":    true,
+	"path":    true,
+	"symlink": true,
+}
+
+// SetChroot makes the HDFS directory root appear as / to clients, who cannot reach anything outside of it
+func (h *ProxyHandler) SetChroot(root string) error {
+	if !strings.HasPrefix(root, "/") {
+		return fmt.Errorf("chroot %q is not an absolute path", root)
+	}
+	if root = path.Clean(root); root == "/" {
+		h.chroot = ""
+		return nil
+	}
+	h.chroot = root
+	registerMetricsSource(func() string {
+		return fmt.Sprintf("proxy_chroot_escapes_total %d\n", h.chrootEscapes.Load())
+	})
+	logger.Printf("Serving HDFS directory %s as /", root)
+	return nil
+}
+
+func escapesRoot(p string) bool {
+	for _, segment := range strings.Split(p, "/") {
+		if segment == ".." {
+			return true
+		}
+	}
+	return false
+}
+
+// checkChroot refuses requests that are not WebHDFS calls, or whose paths climb out of the root with ..
+func (h *ProxyHandler) checkChroot(r *http.Request) *ProxyError {
+	urlPath := r.URL.Path
+	if _, rest, ok := splitDataNodeRoute(urlPath); ok {
+		urlPath = rest
+	}
+	if urlPath != WEBHDFS_PATH_PREFIX && !strings.HasPrefix(urlPath, WEBHDFS_PATH_PREFIX+"/") {
+		h.chrootEscapes.Add(1)
+		return NewProxyError(http.StatusForbidden, "AccessControlException", "org.apache.hadoop.security.AccessControlException",
+			fmt.Sprintf("Path %s is not a WebHDFS path", r.URL.Path))
+	}
+	q, err := webHDFSQuery(r.URL)
+	if err != nil {
+		return NewProxyError(http.StatusBadRequest, "IllegalArgumentException", "java.lang.IllegalArgumentException", err.Error())
+	}
+	paths := append([]string{urlPath, q.Get("destination")}, strings.Split(q.Get("sources"), ",")...)
+	for _, p := range paths {
+		if escapesRoot(p) {
+			h.chrootEscapes.Add(1)
+			return NewProxyError(http.StatusForbidden, "AccessControlException", "org.apache.hadoop.security.AccessControlException",
+				fmt.Sprintf("Path %s leaves the root of this proxy", p))
+		}
+	}
+	return nil
+}
+
+// jailRequest puts the HDFS paths of req, on its way to the backend, under the root. Its parameter
+// names are lowercased so that the backend cannot read a path we did not jail.
+func (h *ProxyHandler) jailRequest(req *http.Request) {
+	if rest, ok := strings.CutPrefix(req.URL.Path, WEBHDFS_PATH_PREFIX); ok {
+		req.URL.Path = WEBHDFS_PATH_PREFIX + h.jailPath(rest)
+		req.URL.RawPath = ""
+	}
+	// checkChroot already refused the queries this fails on
+	q, _ := webHDFSQuery(req.URL)
+	if dest := q.Get("destination"); dest != "" {
+		q.Set("destination", h.jailPath(dest))
+	}
+	if sources := q.Get("sources"); sources != "" {
+		jailed := strings.Split(sources, ",")
+		for i, s := range jailed {
+			jailed[i] = h.jailPath(s)
+		}
+		q.Set("sources", strings.Join(jailed, ","))
+	}
+	req.URL.RawQuery = q.Encode()
+}
+
+func (h *ProxyHandler) jailPath(p string) string {
+	jailed := path.Join(h.chroot, p)
+	if strings.HasSuffix(p, "/") && p != "/" {
+		jailed += "/"
+	}
+	return jailed
+}
+
+// unjailPath gives the path clients see for the HDFS path p, which is kept as is when outside of the root
+func (h *ProxyHandler) unjailPath(p string) string {
+	if p == h.chroot {
+		return "/"
+	}
+	if rest, ok := strings.CutPrefix(p, h.chroot+"/"); ok {
+		return "/" + rest
+	}
+	return p
+}
+
+// unjailURLPath does unjailPath on the HDFS path in a WebHDFS URL path
+func (h *ProxyHandler) unjailURLPath(urlPath string) string {
+	if rest, ok := strings.CutPrefix(urlPath, WEBHDFS_PATH_PREFIX); ok && h.chroot != "" {
+		return WEBHDFS_PATH_PREFIX + h.unjailPath(rest)
+	}
+	return urlPath
+}
+
+func (h *ProxyHandler) unjailJSON(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, field := range v {
+			s, isString := field.(string)
+			switch {
+			case isString && jailedJSONFields[k]:
+				v[k] = h.unjailPath(s)
+			case isString && k == "message":
+				// RemoteException messages name the paths they are about
+				v[k] = strings.ReplaceAll(s, h.chroot+"/", "/")
+			default:
+				v[k] = h.unjailJSON(field)
+			}
+		}
+	case []any:
+		for i, item := range v {
+			v[i] = h.unjailJSON(item)
+		}
+	}
+	return v
+}
+
+// unjailResponse takes the root out of the HDFS paths of JSON answers
+func (h *ProxyHandler) unjailResponse(res *http.Response) error {
+	if !strings.Contains(res.Header.Get("Content-Type"), "json") || res.Header.Get("Content-Encoding") != "" {
+		return nil
+	}
+	if event, _ := ClassifyWebHDFSRequest(res.Request); event == WebHDFSGetOpen {
+		// file contents, whatever they look like
+		return nil
+	}
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(body))
+	// keep file ids and lengths exact
+	decoder.UseNumber()
+	var answer any
+	if err := decoder.Decode(&answer); err == nil {
+		var buf bytes.Buffer
+		encoder := json.NewEncoder(&buf)
+		encoder.SetEscapeHTML(false)
+		if err := encoder.Encode(h.unjailJSON(answer)); err == nil {
+			body = buf.Bytes()
+		}
+	}
+	res.Body = io.NopCloser(bytes.NewReader(body))
+	res.ContentLength = int64(len(body))
+	res.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
@@ -0,0 +1,195 @@
+package spnegoproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestChrootJailRoundTrip(t *testing.T) {
+	h := &ProxyHandler{chroot: "/jail"}
+	tests := []struct {
+		target      string
+		path        string
+		destination string
+		sources     string
+		// the path clients see again
+		unjailed string
+	}{
+		{"/webhdfs/v1/?op=LISTSTATUS", "/webhdfs/v1/jail", "", "", "/webhdfs/v1/"},
+		{"/webhdfs/v1?op=LISTSTATUS", "/webhdfs/v1/jail", "", "", "/webhdfs/v1/"},
+		{"/webhdfs/v1/a/b?op=OPEN", "/webhdfs/v1/jail/a/b", "", "", "/webhdfs/v1/a/b"},
+		{"/webhdfs/v1/a/dir/?op=LISTSTATUS", "/webhdfs/v1/jail/a/dir/", "", "", "/webhdfs/v1/a/dir/"},
+		{"/webhdfs/v1/a?op=RENAME&destination=/b", "/webhdfs/v1/jail/a", "/jail/b", "", "/webhdfs/v1/a"},
+		{"/webhdfs/v1/a?op=RENAME&Destination=/b", "/webhdfs/v1/jail/a", "/jail/b", "", "/webhdfs/v1/a"},
+		{"/webhdfs/v1/a?op=CONCAT&sources=/b,/c", "/webhdfs/v1/jail/a", "", "/jail/b,/jail/c", "/webhdfs/v1/a"},
+		{"/webhdfs/v1/a?op=CONCAT&SOURCES=/b", "/webhdfs/v1/jail/a", "", "/jail/b", "/webhdfs/v1/a"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPut, tt.target, nil)
+		if proxyErr := h.checkChroot(req); proxyErr != nil {
+			t.Fatalf("%s: refused: %s", tt.target, proxyErr)
+		}
+		h.jailRequest(req)
+		if req.URL.Path != tt.path {
+			t.Errorf("%s: backend path %s, want %s", tt.target, req.URL.Path, tt.path)
+		}
+		q, _ := url.ParseQuery(req.URL.RawQuery)
+		if got := q.Get("destination"); got != tt.destination {
+			t.Errorf("%s: backend destination %q, want %q", tt.target, got, tt.destination)
+		}
+		if got := q.Get("sources"); got != tt.sources {
+			t.Errorf("%s: backend sources %q, want %q", tt.target, got, tt.sources)
+		}
+		// the backend must not see a parameter we did not jail
+		for k := range q {
+			if k != strings.ToLower(k) {
+				t.Errorf("%s: backend got parameter %s", tt.target, k)
+			}
+		}
+		if got := h.unjailURLPath(req.URL.Path); got != tt.unjailed {
+			t.Errorf("%s: unjailed path %s, want %s", tt.target, got, tt.unjailed)
+		}
+	}
+}
+
+func TestChrootUnjailPath(t *testing.T) {
+	h := &ProxyHandler{chroot: "/jail"}
+	tests := []struct {
+		hdfsPath string
+		want     string
+	}{
+		{"/jail", "/"},
+		{"/jail/a", "/a"},
+		{"/jail/a/b", "/a/b"},
+		// outside of the root, as is
+		{"/jailbreak", "/jailbreak"},
+		{"/other/a", "/other/a"},
+	}
+	for _, tt := range tests {
+		if got := h.unjailPath(tt.hdfsPath); got != tt.want {
+			t.Errorf("unjailPath(%s) = %s, want %s", tt.hdfsPath, got, tt.want)
+		}
+	}
+}
+
+func TestCheckChroot(t *testing.T) {
+	h := &ProxyHandler{chroot: "/jail"}
+	tests := []struct {
+		target string
+		status int
+	}{
+		{"/webhdfs/v1/a?op=OPEN", 0},
+		{"/webhdfs/v1/a..b?op=OPEN", 0},
+		{"/_dn/dn1.example.com:9864/webhdfs/v1/a?op=OPEN", 0},
+		{"/webhdfs/v1/../a?op=OPEN", http.StatusForbidden},
+		{"/webhdfs/v1/a/%2E%2E/%2E%2E/b?op=OPEN", http.StatusForbidden},
+		{"/_dn/dn1.example.com:9864/webhdfs/v1/../a?op=OPEN", http.StatusForbidden},
+		{"/webhdfs/v1/a?op=RENAME&destination=/../b", http.StatusForbidden},
+		{"/webhdfs/v1/a?op=RENAME&DESTINATION=/../b", http.StatusForbidden},
+		{"/webhdfs/v1/a?op=CONCAT&sources=/b,/../c", http.StatusForbidden},
+		{"/webhdfs/v1/a?op=CONCAT&Sources=/../c", http.StatusForbidden},
+		{"/webhdfs/v1/a?op=RENAME&destination=/b&Destination=/../c", http.StatusBadRequest},
+		{"/webhdfsx/a?op=OPEN", http.StatusForbidden},
+		{"/jmx", http.StatusForbidden},
+		{"/", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodPut, "/", nil)
+		req.URL, _ = url.Parse(tt.target)
+		status := 0
+		if proxyErr := h.checkChroot(req); proxyErr != nil {
+			status = proxyErr.StatusCode
+		}
+		if status != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.target, status, tt.status)
+		}
+	}
+}
+
+func TestChrootUnjailResponse(t *testing.T) {
+	h := &ProxyHandler{chroot: "/jail"}
+	tests := []struct {
+		target string
+		body   string
+		want   string
+	}{
+		{
+			"/webhdfs/v1/a?op=GETFILESTATUS",
+			`{"FileStatus":{"pathSuffix":"","type":"DIRECTORY","fileId":16386123456789012345}}`,
+			`{"FileStatus":{"pathSuffix":"","type":"DIRECTORY","fileId":16386123456789012345}}`,
+		},
+		{
+			"/webhdfs/v1/?op=GETHOMEDIRECTORY",
+			`{"Path":"/jail/user/alice"}`,
+			`{"Path":"/user/alice"}`,
+		},
+		{
+			"/webhdfs/v1/a?op=GETTRASHROOTS",
+			`{"Paths":[{"path":"/jail/a/.Trash"},{"path":"/elsewhere/.Trash"}]}`,
+			`{"Paths":[{"path":"/a/.Trash"},{"path":"/elsewhere/.Trash"}]}`,
+		},
+		{
+			"/webhdfs/v1/a/link?op=GETFILESTATUS",
+			`{"FileStatus":{"type":"SYMLINK","symlink":"/jail/b"}}`,
+			`{"FileStatus":{"type":"SYMLINK","symlink":"/b"}}`,
+		},
+		{
+			"/webhdfs/v1/a?op=LISTSTATUS",
+			`{"RemoteException":{"exception":"FileNotFoundException","message":"File /jail/a does not exist."}}`,
+			`{"RemoteException":{"exception":"FileNotFoundException","message":"File /a does not exist."}}`,
+		},
+	}
+	for _, tt := range tests {
+		res := &http.Response{
+			Header:  http.Header{"Content-Type": {"application/json"}},
+			Body:    io.NopCloser(strings.NewReader(tt.body)),
+			Request: httptest.NewRequest(http.MethodGet, tt.target, nil),
+		}
+		if err := h.unjailResponse(res); err != nil {
+			t.Fatalf("%s: %s", tt.target, err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		got, err := decodeExactJSON(body)
+		if err != nil {
+			t.Fatalf("%s: answer is not JSON: %s", tt.target, body)
+		}
+		if want, _ := decodeExactJSON([]byte(tt.want)); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: answer %s, want %s", tt.target, body, tt.want)
+		}
+		if res.ContentLength != int64(len(body)) {
+			t.Errorf("%s: Content-Length %d, body of %d bytes", tt.target, res.ContentLength, len(body))
+		}
+	}
+}
+
+// decodeExactJSON decodes b keeping numbers as they are written
+func decodeExactJSON(b []byte) (any, error) {
+	decoder := json.NewDecoder(bytes.NewReader(b))
+	decoder.UseNumber()
+	var v any
+	err := decoder.Decode(&v)
+	return v, err
+}
+
+func TestChrootKeepsFileContents(t *testing.T) {
+	h := &ProxyHandler{chroot: "/jail"}
+	const contents = `{"Path":"/jail/a"}`
+	res := &http.Response{
+		Header:  http.Header{"Content-Type": {"application/json"}},
+		Body:    io.NopCloser(strings.NewReader(contents)),
+		Request: httptest.NewRequest(http.MethodGet, "/webhdfs/v1/a.json?op=OPEN", nil),
+	}
+	if err := h.unjailResponse(res); err != nil {
+		t.Fatal(err)
+	}
+	if body, _ := io.ReadAll(res.Body); string(body) != contents {
+		t.Fatalf("file contents changed to %s", body)
+	}
+}
@@ -0,0 +1,202 @@
+package spnegoproxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// circuit breaker defaults
+const DEFAULT_BREAKER_FAILURE_THRESHOLD = 5
+const DEFAULT_BREAKER_COOL_DOWN = time.Second * 30
+
+// BreakerSettings configures the circuit breaker of each backend
+type BreakerSettings struct {
+	// consecutive failures opening the circuit, the breaker is off when not positive
+	FailureThreshold int
+	// how long an open circuit refuses requests before letting probes through
+	CoolDown time.Duration
+	// requests let through at once while half-open
+	HalfOpenProbes int
+}
+
+type breakerState int32
+
+const (
+	breakerClosed breakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s breakerState) String() string {
+	return [...]string{"closed", "open", "half-open"}[s]
+}
+
+// circuitBreaker stops sending requests to a backend that keeps failing, and tries it again after a cool-down
+type circuitBreaker struct {
+	settings BreakerSettings
+	address  string
+	mu       sync.Mutex
+	state    breakerState
+	failures int
+	openedAt time.Time
+	probes   int
+	// bumped on every change of state, so that requests let through before it do not count
+	generation uint64
+	opened     atomic.Uint64
+	refused    atomic.Uint64
+}
+
+func newCircuitBreaker(settings BreakerSettings, address string) *circuitBreaker {
+	if settings.HalfOpenProbes < 1 {
+		settings.HalfOpenProbes = 1
+	}
+	return &circuitBreaker{settings: settings, address: address}
+}
+
+// ready tells whether allow could let a request through, without taking a probe slot
+func (b *circuitBreaker) ready() bool {
+	if b == nil {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case breakerOpen:
+		return time.Since(b.openedAt) >= b.settings.CoolDown
+	case breakerHalfOpen:
+		return b.probes < b.settings.HalfOpenProbes
+	default:
+		return true
+	}
+}
+
+// breakerTicket is what allow hands a request it lets through, done needs it back
+type breakerTicket struct {
+	generation uint64
+	// the request holds a probe slot of the half-open circuit
+	probe bool
+}
+
+// allow tells whether a request may go to the backend, its outcome must then be given to done with the ticket
+func (b *circuitBreaker) allow() (breakerTicket, bool) {
+	if b == nil {
+		return breakerTicket{}, true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == breakerOpen && time.Since(b.openedAt) >= b.settings.CoolDown {
+		logger.Printf("Circuit of backend %s is half-open, probing it", b.address)
+		b.setState(breakerHalfOpen)
+	}
+	switch {
+	case b.state == breakerOpen, b.state == breakerHalfOpen && b.probes >= b.settings.HalfOpenProbes:
+		b.refused.Add(1)
+		return breakerTicket{}, false
+	case b.state == breakerHalfOpen:
+		b.probes++
+		return breakerTicket{b.generation, true}, true
+	}
+	return breakerTicket{b.generation, false}, true
+}
+
+// done records the outcome of a request allow let through. Requests let through before the last
+// change of state say nothing about the current one and are not counted.
+func (b *circuitBreaker) done(ticket breakerTicket, result *requestResult) {
+	if b == nil {
+		return
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if ticket.generation != b.generation {
+		return
+	}
+	if ticket.probe {
+		b.probes--
+	}
+	switch {
+	case result.canceled:
+		// the client went away, this says nothing about the backend
+	case !result.failed:
+		if b.state != breakerClosed {
+			logger.Printf("Circuit of backend %s is closed again", b.address)
+			b.setState(breakerClosed)
+		}
+		b.failures = 0
+	case b.state == breakerHalfOpen:
+		b.trip("its probe failed")
+	case b.state == breakerClosed:
+		if b.failures++; b.failures >= b.settings.FailureThreshold {
+			b.trip(fmt.Sprintf("%d consecutive failures", b.failures))
+		}
+	}
+}
+
+// trip opens the circuit, b.mu must be held
+func (b *circuitBreaker) trip(why string) {
+	logger.Printf("Opening circuit of backend %s for %s: %s", b.address, b.settings.CoolDown, why)
+	b.setState(breakerOpen)
+	b.openedAt = time.Now()
+	b.opened.Add(1)
+}
+
+// setState moves the circuit to state, b.mu must be held
+func (b *circuitBreaker) setState(state breakerState) {
+	b.state, b.failures, b.probes = state, 0, 0
+	b.generation++
+}
+
+func (b *circuitBreaker) metrics() string {
+	b.mu.Lock()
+	state := b.state
+	b.mu.Unlock()
+	return fmt.Sprintf("proxy_backend_circuit_state{backend=%q,state=%q} %d\n", b.address, state, state) +
+		fmt.Sprintf("proxy_backend_circuit_opened_total{backend=%q} %d\n", b.address, b.opened.Load()) +
+		fmt.Sprintf("proxy_backend_circuit_refused_total{backend=%q} %d\n", b.address, b.refused.Load())
+}
+
+// requestResult collects what happened to a request on its way through the proxy, for the circuit breaker
+type requestResult struct {
+	failed   bool
+	canceled bool
+}
+
+func requestResultFromContext(ctx context.Context) *requestResult {
+	result, _ := ctx.Value(requestResultContextKey).(*requestResult)
+	return result
+}
+
+// backendFailed tells whether a backend answer counts as a failure of the backend
+func backendFailed(res *http.Response) bool {
+	switch res.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+// SetCircuitBreaker gives each backend of the pool a circuit breaker, none when settings.FailureThreshold is not positive
+func (p *BackendPool) SetCircuitBreaker(settings BreakerSettings) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if settings.FailureThreshold <= 0 {
+		p.breakerSettings = nil
+	} else {
+		p.breakerSettings = &settings
+	}
+	for _, b := range p.backends {
+		b.breaker = p.newBreaker(b.Address())
+	}
+}
+
+// newBreaker builds the circuit breaker of a new backend, p.mu must be held
+func (p *BackendPool) newBreaker(address string) *circuitBreaker {
+	if p.breakerSettings == nil {
+		return nil
+	}
+	return newCircuitBreaker(*p.breakerSettings, address)
+}
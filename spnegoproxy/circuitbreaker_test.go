@@ -0,0 +1,309 @@
+package spnegoproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var (
+	resultOK       = &requestResult{}
+	resultFailed   = &requestResult{failed: true}
+	resultCanceled = &requestResult{canceled: true}
+)
+
+func newTestBreaker() *circuitBreaker {
+	return newCircuitBreaker(BreakerSettings{FailureThreshold: 3, CoolDown: time.Minute, HalfOpenProbes: 1}, "backend:50070")
+}
+
+// coolDown makes an open circuit ready to be probed
+func coolDown(b *circuitBreaker) {
+	b.mu.Lock()
+	b.openedAt = time.Now().Add(-b.settings.CoolDown)
+	b.mu.Unlock()
+}
+
+func mustAllow(t *testing.T, b *circuitBreaker) breakerTicket {
+	t.Helper()
+	ticket, ok := b.allow()
+	if !ok {
+		t.Fatalf("allow refused a request in state %s", b.state)
+	}
+	return ticket
+}
+
+func expectState(t *testing.T, b *circuitBreaker, want breakerState) {
+	t.Helper()
+	if b.state != want {
+		t.Fatalf("state = %s, want %s", b.state, want)
+	}
+}
+
+func TestBreakerOpensAfterConsecutiveFailures(t *testing.T) {
+	b := newTestBreaker()
+	for i := 0; i < 2; i++ {
+		b.done(mustAllow(t, b), resultFailed)
+	}
+	// a success in between starts the count over
+	b.done(mustAllow(t, b), resultOK)
+	for i := 0; i < 2; i++ {
+		b.done(mustAllow(t, b), resultFailed)
+	}
+	expectState(t, b, breakerClosed)
+	b.done(mustAllow(t, b), resultFailed)
+	expectState(t, b, breakerOpen)
+	if _, ok := b.allow(); ok {
+		t.Fatal("an open circuit let a request through")
+	}
+	if b.refused.Load() != 1 || b.opened.Load() != 1 {
+		t.Fatalf("refused = %d, opened = %d, want 1 and 1", b.refused.Load(), b.opened.Load())
+	}
+}
+
+func TestBreakerIgnoresCanceledRequests(t *testing.T) {
+	b := newTestBreaker()
+	for i := 0; i < 5; i++ {
+		b.done(mustAllow(t, b), resultCanceled)
+	}
+	expectState(t, b, breakerClosed)
+	if b.failures != 0 {
+		t.Fatalf("failures = %d, want 0", b.failures)
+	}
+}
+
+func TestBreakerHalfOpenProbe(t *testing.T) {
+	tests := []struct {
+		name   string
+		result *requestResult
+		want   breakerState
+	}{
+		{"success closes", resultOK, breakerClosed},
+		{"failure opens again", resultFailed, breakerOpen},
+		{"cancel keeps probing", resultCanceled, breakerHalfOpen},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			b := newTestBreaker()
+			b.trip("test")
+			coolDown(b)
+			probe := mustAllow(t, b)
+			expectState(t, b, breakerHalfOpen)
+			if !probe.probe {
+				t.Fatal("the first request after the cool-down is not a probe")
+			}
+			if _, ok := b.allow(); ok {
+				t.Fatal("a second request got through while the only probe slot is taken")
+			}
+			b.done(probe, tt.result)
+			expectState(t, b, tt.want)
+			if b.probes != 0 {
+				t.Fatalf("probes = %d, want 0", b.probes)
+			}
+		})
+	}
+}
+
+func TestBreakerIgnoresRequestsFromAnEarlierState(t *testing.T) {
+	b := newTestBreaker()
+	// let through while closed, finishing once the circuit is half-open
+	late := []breakerTicket{mustAllow(t, b), mustAllow(t, b)}
+	b.trip("test")
+	coolDown(b)
+	probe := mustAllow(t, b)
+
+	b.done(late[0], resultOK)
+	expectState(t, b, breakerHalfOpen)
+	b.done(late[1], resultFailed)
+	expectState(t, b, breakerHalfOpen)
+	if b.probes != 1 {
+		t.Fatalf("probes = %d, want 1", b.probes)
+	}
+
+	b.done(probe, resultOK)
+	expectState(t, b, breakerClosed)
+	if b.probes != 0 {
+		t.Fatalf("probes = %d, want 0", b.probes)
+	}
+}
+
+func TestBreakerIgnoresProbesOfAnEarlierHalfOpenState(t *testing.T) {
+	b := newCircuitBreaker(BreakerSettings{FailureThreshold: 1, CoolDown: time.Minute, HalfOpenProbes: 2}, "backend:50070")
+	b.trip("test")
+	coolDown(b)
+	first, second := mustAllow(t, b), mustAllow(t, b)
+	b.done(first, resultFailed)
+	expectState(t, b, breakerOpen)
+	coolDown(b)
+	probe := mustAllow(t, b)
+	// the second probe belongs to the circuit that was opened since
+	b.done(second, resultOK)
+	expectState(t, b, breakerHalfOpen)
+	if b.probes != 1 {
+		t.Fatalf("probes = %d, want 1", b.probes)
+	}
+	b.done(probe, resultOK)
+	expectState(t, b, breakerClosed)
+}
+
+func TestNilBreakerAllowsEverything(t *testing.T) {
+	var b *circuitBreaker
+	ticket, ok := b.allow()
+	if !ok || !b.ready() {
+		t.Fatal("a missing breaker refused a request")
+	}
+	b.done(ticket, resultFailed)
+}
+
+// flakyBackend answers 503 while failing, and holds requests while held
+type flakyBackend struct {
+	*httptest.Server
+	failing atomic.Bool
+	held    atomic.Bool
+	hits    atomic.Int32
+	release chan struct{}
+}
+
+func newFlakyBackend(t *testing.T) *flakyBackend {
+	f := &flakyBackend{release: make(chan struct{})}
+	f.Server = newTestBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		f.hits.Add(1)
+		if f.held.Load() {
+			<-f.release
+		}
+		if f.failing.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	})
+	return f
+}
+
+func backendAt(t *testing.T, pool *BackendPool, address string) *Backend {
+	t.Helper()
+	for _, b := range pool.Backends() {
+		if b.Address() == address {
+			return b
+		}
+	}
+	t.Fatalf("no backend %s in the pool", address)
+	return nil
+}
+
+// getThroughProxy sends n requests and checks they all got status
+func getThroughProxy(t *testing.T, proxy *httptest.Server, n int, status int) {
+	t.Helper()
+	for i := 0; i < n; i++ {
+		res, err := http.Get(proxy.URL + "/webhdfs/v1/a?op=GETFILESTATUS")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != status {
+			t.Fatalf("request %d: status %d, want %d", i+1, res.StatusCode, status)
+		}
+	}
+}
+
+// probeThroughProxy sends requests in the background until one of them reaches the flaky backend,
+// which then holds it when held is set. It returns where the probe's status arrives.
+func probeThroughProxy(t *testing.T, proxy *httptest.Server, f *flakyBackend) <-chan int {
+	t.Helper()
+	hits := f.hits.Load()
+	for i := 0; i < 4; i++ {
+		status := make(chan int, 1)
+		go func() {
+			res, err := http.Get(proxy.URL + "/webhdfs/v1/a?op=GETFILESTATUS")
+			if err != nil {
+				status <- 0
+				return
+			}
+			res.Body.Close()
+			status <- res.StatusCode
+		}()
+		deadline := time.After(5 * time.Second)
+		for {
+			if f.hits.Load() > hits {
+				return status
+			}
+			select {
+			case code := <-status:
+				if f.hits.Load() > hits {
+					status <- code
+					return status
+				}
+				// another backend took it, round-robin moves on
+			case <-deadline:
+				t.Fatal("request got stuck")
+			case <-time.After(5 * time.Millisecond):
+				continue
+			}
+			break
+		}
+	}
+	t.Fatal("no request reached the backend whose circuit is half-open")
+	return nil
+}
+
+func TestBreakerHalfOpenThroughPick(t *testing.T) {
+	flaky := newFlakyBackend(t)
+	var goodHits atomic.Int32
+	good := newTestBackend(t, func(w http.ResponseWriter, r *http.Request) { goodHits.Add(1) })
+	h, proxy := newTestProxy(t, testHostPort(t, flaky.URL), testHostPort(t, good.URL))
+	h.pool.SetCircuitBreaker(BreakerSettings{FailureThreshold: 2, CoolDown: time.Minute, HalfOpenProbes: 1})
+	breaker := backendAt(t, h.pool, testHostPort(t, flaky.URL).f()).breaker
+
+	flaky.failing.Store(true)
+	for breaker.opened.Load() == 0 {
+		res, err := http.Get(proxy.URL + "/webhdfs/v1/a?op=GETFILESTATUS")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if flaky.hits.Load() > 2 {
+			t.Fatalf("circuit still closed after %d failures", flaky.hits.Load())
+		}
+	}
+	// the good backend takes everything while the circuit is open
+	flakyHits, before := flaky.hits.Load(), goodHits.Load()
+	getThroughProxy(t, proxy, 4, http.StatusOK)
+	if flaky.hits.Load() != flakyHits || goodHits.Load() != before+4 {
+		t.Fatalf("open circuit got %d requests", flaky.hits.Load()-flakyHits)
+	}
+
+	// a failed probe opens it again
+	coolDown(breaker)
+	if status := <-probeThroughProxy(t, proxy, flaky); status != http.StatusServiceUnavailable {
+		t.Fatalf("failed probe answered %d", status)
+	}
+	expectState(t, breaker, breakerOpen)
+	flakyHits = flaky.hits.Load()
+	getThroughProxy(t, proxy, 4, http.StatusOK)
+	if flaky.hits.Load() != flakyHits {
+		t.Fatal("circuit opened again by a failed probe got requests")
+	}
+
+	// nothing but the probe goes through while it is running
+	coolDown(breaker)
+	flaky.failing.Store(false)
+	flaky.held.Store(true)
+	probe := probeThroughProxy(t, proxy, flaky)
+	expectState(t, breaker, breakerHalfOpen)
+	flakyHits = flaky.hits.Load()
+	getThroughProxy(t, proxy, 4, http.StatusOK)
+	if flaky.hits.Load() != flakyHits {
+		t.Fatal("a request went along with the probe")
+	}
+	flaky.held.Store(false)
+	close(flaky.release)
+	if status := <-probe; status != http.StatusOK {
+		t.Fatalf("probe answered %d", status)
+	}
+	expectState(t, breaker, breakerClosed)
+	// and both backends take requests again
+	flakyHits = flaky.hits.Load()
+	getThroughProxy(t, proxy, 4, http.StatusOK)
+	if flaky.hits.Load() != flakyHits+2 {
+		t.Fatalf("closed circuit got %d of 4 requests, want 2", flaky.hits.Load()-flakyHits)
+	}
+}
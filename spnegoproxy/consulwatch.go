@@ -0,0 +1,111 @@
+package spnegoproxy
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	capi "github.com/hashicorp/consul/api"
+)
+
+// how long a single blocking query may wait for a change on the consul side
+const CONSUL_WAIT_TIME = time.Minute * 5
+
+// backoff bounds when consul cannot be reached
+const CONSUL_MIN_RETRY_TIME = time.Second * 1
+const CONSUL_MAX_RETRY_TIME = time.Second * 30
+
+type consulWatchStats struct {
+	lastIndex atomic.Uint64
+	updates   atomic.Uint64
+	errors    atomic.Uint64
+	healthy   atomic.Int64
+}
+
+// DeregisterConsulService removes the service instance serviceID from the local consul agent client talks
+// to, which must be the one it was registered with, so that clients stop being sent to this proxy
+func DeregisterConsulService(client *capi.Client, serviceID string) error {
+	if err := client.Agent().ServiceDeregister(serviceID); err != nil {
+		return fmt.Errorf("cannot deregister %s from consul: %w", serviceID, err)
+	}
+	logger.Printf("Deregistered %s from consul", serviceID)
+	return nil
+}
+
+// StartConsulGetService watches the healthy instances of serviceName and sends every change on the returned channel.
+// The first message is sent as soon as consul answers.
+func StartConsulGetService(client *capi.Client, serviceName string) chan []HostPort {
+	messages := make(chan []HostPort, 1)
+	go WatchConsulService(client, serviceName, messages, nil)
+	return messages
+}
+
+// WatchConsulService runs consul blocking queries on the health of serviceName until stop is closed,
+// sending the list of healthy instances to messages each time it changes
+func WatchConsulService(client *capi.Client, serviceName string, messages chan<- []HostPort, stop <-chan struct{}) {
+	stats := &consulWatchStats{}
+	registerMetricsSource(func() string { return stats.String(serviceName) })
+	var lastIndex uint64
+	var current []HostPort
+	sent := false
+	retryTime := CONSUL_MIN_RETRY_TIME
+	for {
+		select {
+		case <-stop:
+			return
+		default:
+		}
+		healthyServices, meta, err := client.Health().Service(serviceName, "", true, &capi.QueryOptions{
+			WaitIndex: lastIndex,
+			WaitTime:  CONSUL_WAIT_TIME,
+		})
+		if err != nil {
+			stats.errors.Add(1)
+			logger.Printf("Cannot get healthy services for %#v (response meta: %#v) because of a consul error: %s, retrying in %s", serviceName, meta, err, retryTime)
+			select {
+			case <-stop:
+				return
+			case <-time.After(retryTime):
+			}
+			retryTime = min(retryTime*2, CONSUL_MAX_RETRY_TIME)
+			continue
+		}
+		retryTime = CONSUL_MIN_RETRY_TIME
+		// the index can go backwards, e.g. after a consul snapshot restore: start over
+		if meta.LastIndex < lastIndex {
+			lastIndex = 0
+		} else {
+			lastIndex = meta.LastIndex
+		}
+		stats.lastIndex.Store(lastIndex)
+		healthyStrings := make([]HostPort, len(healthyServices))
+		for i := range healthyServices {
+			healthyStrings[i] = HostPort{healthyServices[i].Node.Meta["fqdn"], healthyServices[i].Service.Port}
+		}
+		slices.SortFunc(healthyStrings, func(a, b HostPort) int {
+			return cmp.Or(strings.Compare(a.Host, b.Host), cmp.Compare(a.Port, b.Port))
+		})
+		if sent && slices.Equal(current, healthyStrings) {
+			continue
+		}
+		logger.Printf("Consul service %s now has %d healthy instances: %v", serviceName, len(healthyStrings), healthyStrings)
+		current, sent = healthyStrings, true
+		stats.updates.Add(1)
+		stats.healthy.Store(int64(len(healthyStrings)))
+		select {
+		case <-stop:
+			return
+		case messages <- healthyStrings:
+		}
+	}
+}
+
+func (s *consulWatchStats) String(serviceName string) string {
+	return fmt.Sprintf("consul_watch_last_index{service=%q} %d\n", serviceName, s.lastIndex.Load()) +
+		fmt.Sprintf("consul_watch_updates_total{service=%q} %d\n", serviceName, s.updates.Load()) +
+		fmt.Sprintf("consul_watch_errors_total{service=%q} %d\n", serviceName, s.errors.Load()) +
+		fmt.Sprintf("consul_watch_healthy_instances{service=%q} %d\n", serviceName, s.healthy.Load())
+}
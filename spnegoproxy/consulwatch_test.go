@@ -0,0 +1,237 @@
+package spnegoproxy
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	capi "github.com/hashicorp/consul/api"
+)
+
+// fakeConsulAnswer is what the fake consul answers to one health query
+type fakeConsulAnswer struct {
+	status int
+	index  uint64
+	hosts  []HostPort
+}
+
+type fakeConsulQuery struct {
+	index uint64
+	at    time.Time
+}
+
+// fakeConsul serves its answers in turn to the blocking health queries of a service, then blocks
+// as consul does when nothing changes
+type fakeConsul struct {
+	*httptest.Server
+	mu      sync.Mutex
+	answers []fakeConsulAnswer
+	queries []fakeConsulQuery
+	closed  chan struct{}
+	release sync.Once
+}
+
+func newFakeConsul(t *testing.T, service string, answers ...fakeConsulAnswer) *fakeConsul {
+	f := &fakeConsul{answers: answers, closed: make(chan struct{})}
+	f.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/health/service/"+service || r.URL.Query().Get("passing") == "" {
+			t.Errorf("unexpected consul query %s", r.URL)
+			http.NotFound(w, r)
+			return
+		}
+		index, _ := strconv.ParseUint(r.URL.Query().Get("index"), 10, 64)
+		f.mu.Lock()
+		f.queries = append(f.queries, fakeConsulQuery{index, time.Now()})
+		if len(f.answers) == 0 {
+			f.mu.Unlock()
+			select {
+			case <-r.Context().Done():
+			case <-f.closed:
+			}
+			return
+		}
+		answer := f.answers[0]
+		f.answers = f.answers[1:]
+		f.mu.Unlock()
+		if answer.status != http.StatusOK {
+			http.Error(w, "consul is having a bad day", answer.status)
+			return
+		}
+		entries := make([]*capi.ServiceEntry, len(answer.hosts))
+		for i, hp := range answer.hosts {
+			entries[i] = &capi.ServiceEntry{
+				Node:    &capi.Node{Node: hp.Host, Meta: map[string]string{"fqdn": hp.Host}},
+				Service: &capi.AgentService{Service: service, Port: hp.Port},
+			}
+		}
+		w.Header().Set("X-Consul-Index", strconv.FormatUint(answer.index, 10))
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(entries)
+	}))
+	t.Cleanup(func() {
+		f.unblock()
+		f.Close()
+	})
+	return f
+}
+
+// unblock ends the queries waiting for a change
+func (f *fakeConsul) unblock() {
+	f.release.Do(func() { close(f.closed) })
+}
+
+func (f *fakeConsul) client(t *testing.T) *capi.Client {
+	client, err := capi.NewClient(&capi.Config{Address: strings.TrimPrefix(f.URL, "http://")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// queriesSoFar returns the queries consul got, once it got at least n of them
+func (f *fakeConsul) queriesSoFar(t *testing.T, n int) []fakeConsulQuery {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		f.mu.Lock()
+		queries := slices.Clone(f.queries)
+		f.mu.Unlock()
+		if len(queries) >= n {
+			return queries
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("consul got %d queries, want %d", len(queries), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func queriedIndexes(queries []fakeConsulQuery) []uint64 {
+	indexes := make([]uint64, len(queries))
+	for i, q := range queries {
+		indexes[i] = q.index
+	}
+	return indexes
+}
+
+func watchFakeConsul(t *testing.T, f *fakeConsul, service string) <-chan []HostPort {
+	messages := make(chan []HostPort)
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		WatchConsulService(f.client(t), service, messages, stop)
+	}()
+	t.Cleanup(func() {
+		close(stop)
+		f.unblock()
+		<-done
+	})
+	return messages
+}
+
+func expectHosts(t *testing.T, messages <-chan []HostPort, want ...HostPort) {
+	t.Helper()
+	select {
+	case got := <-messages:
+		if !slices.Equal(got, want) {
+			t.Fatalf("got hosts %v, want %v", got, want)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("no hosts sent, want %v", want)
+	}
+}
+
+func expectNoHosts(t *testing.T, messages <-chan []HostPort) {
+	t.Helper()
+	select {
+	case got := <-messages:
+		t.Fatalf("got hosts %v, want none", got)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+var (
+	nn1 = HostPort{"nn1.example.com", 50070}
+	nn2 = HostPort{"nn2.example.com", 50070}
+)
+
+func TestWatchConsulServiceFollowsMembership(t *testing.T) {
+	f := newFakeConsul(t, "hdfs",
+		fakeConsulAnswer{http.StatusOK, 10, []HostPort{nn1}},
+		// same members under a new index, nothing to send
+		fakeConsulAnswer{http.StatusOK, 11, []HostPort{nn1}},
+		// consul does not sort its answers
+		fakeConsulAnswer{http.StatusOK, 12, []HostPort{nn2, nn1}},
+		fakeConsulAnswer{http.StatusOK, 13, []HostPort{nn1, nn2}},
+		fakeConsulAnswer{http.StatusOK, 14, []HostPort{nn2}},
+		fakeConsulAnswer{http.StatusOK, 15, nil},
+	)
+	messages := watchFakeConsul(t, f, "hdfs")
+	expectHosts(t, messages, nn1)
+	expectHosts(t, messages, nn1, nn2)
+	expectHosts(t, messages, nn2)
+	expectHosts(t, messages)
+	expectNoHosts(t, messages)
+	want := []uint64{0, 10, 11, 12, 13, 14, 15}
+	if got := queriedIndexes(f.queriesSoFar(t, len(want))); !slices.Equal(got, want) {
+		t.Fatalf("queried indexes %v, want %v", got, want)
+	}
+}
+
+func TestWatchConsulServiceStartsOverWhenTheIndexGoesBack(t *testing.T) {
+	f := newFakeConsul(t, "hdfs",
+		fakeConsulAnswer{http.StatusOK, 50, []HostPort{nn1}},
+		// e.g. a snapshot restore
+		fakeConsulAnswer{http.StatusOK, 20, []HostPort{nn1}},
+		fakeConsulAnswer{http.StatusOK, 21, []HostPort{nn2}},
+	)
+	messages := watchFakeConsul(t, f, "hdfs")
+	expectHosts(t, messages, nn1)
+	expectHosts(t, messages, nn2)
+	want := []uint64{0, 50, 0, 21}
+	if got := queriedIndexes(f.queriesSoFar(t, len(want))); !slices.Equal(got, want) {
+		t.Fatalf("queried indexes %v, want %v", got, want)
+	}
+}
+
+func TestWatchConsulServiceBacksOffOnErrors(t *testing.T) {
+	if testing.Short() {
+		t.Skip("waits for the consul retry backoff")
+	}
+	f := newFakeConsul(t, "hdfs",
+		fakeConsulAnswer{status: http.StatusInternalServerError},
+		fakeConsulAnswer{status: http.StatusInternalServerError},
+		fakeConsulAnswer{http.StatusOK, 7, []HostPort{nn1}},
+		fakeConsulAnswer{status: http.StatusInternalServerError},
+		fakeConsulAnswer{http.StatusOK, 8, []HostPort{nn2}},
+	)
+	messages := watchFakeConsul(t, f, "hdfs")
+	expectHosts(t, messages, nn1)
+	expectHosts(t, messages, nn2)
+	queries := f.queriesSoFar(t, 5)
+	if got, want := queriedIndexes(queries), []uint64{0, 0, 0, 7, 7}; !slices.Equal(got[:5], want) {
+		t.Fatalf("queried indexes %v, want %v", got, want)
+	}
+	waits := []struct {
+		after    int
+		min, max time.Duration
+	}{
+		{0, CONSUL_MIN_RETRY_TIME, 2 * CONSUL_MIN_RETRY_TIME},
+		// the wait doubles on each failure in a row
+		{1, 2 * CONSUL_MIN_RETRY_TIME, 4 * CONSUL_MIN_RETRY_TIME},
+		// and starts over after a success
+		{3, CONSUL_MIN_RETRY_TIME, 2 * CONSUL_MIN_RETRY_TIME},
+	}
+	for _, w := range waits {
+		if wait := queries[w.after+1].at.Sub(queries[w.after].at); wait < w.min || wait >= w.max {
+			t.Errorf("query %d came %s after the failed one, want between %s and %s", w.after+2, wait, w.min, w.max)
+		}
+	}
+}
@@ -0,0 +1,305 @@
+package spnegoproxy
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// RedirectMode tells what the proxy does with the redirects WebHDFS sends towards DataNodes
+type RedirectMode string
+
+const (
+	// give the redirect back to the client, which then needs to reach the DataNode itself
+	RedirectPassthrough RedirectMode = "passthrough"
+	// follow the redirect from the proxy and stream the data through
+	RedirectFollow RedirectMode = "follow"
+	// point the redirect back at the proxy, which forwards it to the DataNode on the client's second request
+	RedirectRewrite RedirectMode = "rewrite"
+)
+
+// prefix of the proxy routes leading to a DataNode, as in /_dn/<host>:<port>/webhdfs/v1/...
+const DATANODE_ROUTE_PREFIX = "/_dn/"
+
+// how long a DataNode stays reachable through the proxy after the NameNode last redirected to it
+const DATANODE_ROUTE_TTL = time.Hour * 1
+
+// how long a client has to follow a rewritten redirect before the delegation token it stands for is dropped
+const DATANODE_TOKEN_TTL = time.Minute * 5
+
+// query parameter of rewritten redirects naming the delegation token the proxy took out of them
+const DATANODE_TOKEN_PARAM = "dntoken"
+
+func ParseRedirectMode(s string) (RedirectMode, error) {
+	switch mode := RedirectMode(strings.ToLower(s)); mode {
+	case RedirectPassthrough, RedirectFollow, RedirectRewrite:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown redirect mode %q (want one of %s, %s, %s)", s, RedirectPassthrough, RedirectFollow, RedirectRewrite)
+	}
+}
+
+// the operations for which the NameNode sends the client to a DataNode
+var redirectedWebHDFSEvents = map[WebHDFSEvent]bool{
+	WebHDFSGetOpen:    true,
+	WebHDFSPutCreate:  true,
+	WebHDFSPostAppend: true,
+}
+
+type redirectStats struct {
+	followed  atomic.Uint64
+	failed    atomic.Uint64
+	rewritten atomic.Uint64
+	routed    atomic.Uint64
+	refused   atomic.Uint64
+}
+
+func (s *redirectStats) String() string {
+	return fmt.Sprintf("proxy_datanode_redirects_followed_total %d\n", s.followed.Load()) +
+		fmt.Sprintf("proxy_datanode_redirects_failed_total %d\n", s.failed.Load()) +
+		fmt.Sprintf("proxy_datanode_redirects_rewritten_total %d\n", s.rewritten.Load()) +
+		fmt.Sprintf("proxy_datanode_routed_requests_total %d\n", s.routed.Load()) +
+		fmt.Sprintf("proxy_datanode_refused_requests_total %d\n", s.refused.Load())
+}
+
+// dataNodeRoutes remembers the DataNodes the NameNode redirected clients to, only those can be reached
+// through the proxy so that it cannot be used to talk to any host
+type dataNodeRoutes struct {
+	mu     sync.Mutex
+	seen   map[string]time.Time
+	tokens map[string]dataNodeToken
+}
+
+// dataNodeToken is a delegation token the NameNode put in a redirect to hostport
+type dataNodeToken struct {
+	hostport string
+	token    string
+	added    time.Time
+}
+
+func (d *dataNodeRoutes) allow(hostport string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	if d.seen == nil {
+		d.seen = make(map[string]time.Time)
+	}
+	for dn, last := range d.seen {
+		if now.Sub(last) > DATANODE_ROUTE_TTL {
+			delete(d.seen, dn)
+		}
+	}
+	d.seen[hostport] = now
+}
+
+func (d *dataNodeRoutes) allowed(hostport string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	last, ok := d.seen[hostport]
+	return ok && time.Since(last) <= DATANODE_ROUTE_TTL
+}
+
+// keepToken stores the delegation token of a redirect to hostport, and returns the reference clients get instead
+func (d *dataNodeRoutes) keepToken(hostport string, token string) string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	ref := hex.EncodeToString(b)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	if d.tokens == nil {
+		d.tokens = make(map[string]dataNodeToken)
+	}
+	for r, t := range d.tokens {
+		if now.Sub(t.added) > DATANODE_TOKEN_TTL {
+			delete(d.tokens, r)
+		}
+	}
+	d.tokens[ref] = dataNodeToken{hostport, token, now}
+	return ref
+}
+
+// token returns the delegation token ref stands for, "" when it is unknown, expired or not for hostport
+func (d *dataNodeRoutes) token(hostport string, ref string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	t, ok := d.tokens[ref]
+	if !ok || t.hostport != hostport || time.Since(t.added) > DATANODE_TOKEN_TTL {
+		return ""
+	}
+	return t.token
+}
+
+// splitDataNodeRoute splits /_dn/<host>:<port>/rest into <host>:<port> and /rest
+func splitDataNodeRoute(path string) (hostport string, rest string, ok bool) {
+	if !strings.HasPrefix(path, DATANODE_ROUTE_PREFIX) {
+		return "", "", false
+	}
+	hostport, rest, _ = strings.Cut(strings.TrimPrefix(path, DATANODE_ROUTE_PREFIX), "/")
+	if _, _, err := net.SplitHostPort(hostport); err != nil {
+		return "", "", false
+	}
+	return hostport, "/" + rest, true
+}
+
+// dataNodeBackend builds the target of a request made on a DataNode route
+func (h *ProxyHandler) dataNodeBackend(r *http.Request) (*Backend, *ProxyError) {
+	hostport, _, ok := splitDataNodeRoute(r.URL.Path)
+	if !ok {
+		return nil, NewProxyError(http.StatusBadRequest, "IllegalArgumentException", "java.lang.IllegalArgumentException",
+			fmt.Sprintf("invalid DataNode route %s", r.URL.Path))
+	}
+	if h.redirectMode != RedirectRewrite || !h.dataNodes.allowed(hostport) {
+		h.redirects.refused.Add(1)
+		return nil, NewProxyError(http.StatusForbidden, "AccessControlException", "org.apache.hadoop.security.AccessControlException",
+			fmt.Sprintf("DataNode %s is not reachable through this proxy", hostport))
+	}
+	host, portS, _ := net.SplitHostPort(hostport)
+	port, _ := strconv.Atoi(portS)
+	h.redirects.routed.Add(1)
+	return &Backend{HostPort: HostPort{host, port}, dataNode: true}, nil
+}
+
+// proxyURLForDataNode builds the proxy URL a client must use to reach location
+func (h *ProxyHandler) proxyURLForDataNode(ctx context.Context, location *url.URL) string {
+	proxyURL := *clientURLFromContext(ctx)
+	proxyURL.Path = DATANODE_ROUTE_PREFIX + location.Host + h.unjailURLPath(location.Path)
+	proxyURL.RawPath = ""
+	// the token is one of the proxy principal, clients get a reference to it which works through the proxy only
+	q := location.Query()
+	if token := q.Get("delegation"); token != "" {
+		q.Del("delegation")
+		q.Set(DATANODE_TOKEN_PARAM, h.dataNodes.keepToken(location.Host, token))
+	}
+	proxyURL.RawQuery = q.Encode()
+	return proxyURL.String()
+}
+
+// restoreDataNodeToken puts back in req, on its way to DataNode hostport, the delegation token
+// proxyURLForDataNode took out of the redirect the client follows
+func (h *ProxyHandler) restoreDataNodeToken(req *http.Request, hostport string) {
+	q := req.URL.Query()
+	ref := q.Get(DATANODE_TOKEN_PARAM)
+	if ref == "" {
+		return
+	}
+	for k := range q {
+		if k == DATANODE_TOKEN_PARAM || strings.EqualFold(k, "delegation") {
+			q.Del(k)
+		}
+	}
+	if token := h.dataNodes.token(hostport, ref); token != "" {
+		q.Set("delegation", token)
+	}
+	req.URL.RawQuery = q.Encode()
+}
+
+// rewriteRedirect points DataNode redirects of the NameNode, be they 307s or noredirect=true
+// JSON answers, back at the proxy
+func (h *ProxyHandler) rewriteRedirect(res *http.Response) error {
+	ctx := res.Request.Context()
+	if res.StatusCode == http.StatusTemporaryRedirect {
+		location, err := res.Location()
+		if err != nil || location.Host == "" {
+			return nil
+		}
+		h.dataNodes.allow(location.Host)
+		res.Header.Set("Location", h.proxyURLForDataNode(ctx, location))
+		h.redirects.rewritten.Add(1)
+		return nil
+	}
+	event, err := ClassifyWebHDFSRequest(res.Request)
+	if res.StatusCode != http.StatusOK || err != nil || !redirectedWebHDFSEvents[event] || res.Request.URL.Query().Get("noredirect") != "true" {
+		return nil
+	}
+	body, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return err
+	}
+	var answer map[string]any
+	if err := json.Unmarshal(body, &answer); err == nil {
+		if raw, ok := answer["Location"].(string); ok {
+			if location, err := url.Parse(raw); err == nil && location.Host != "" {
+				h.dataNodes.allow(location.Host)
+				answer["Location"] = h.proxyURLForDataNode(ctx, location)
+				body, _ = json.Marshal(answer)
+				h.redirects.rewritten.Add(1)
+			}
+		}
+	}
+	res.Body = io.NopCloser(bytes.NewReader(body))
+	res.ContentLength = int64(len(body))
+	res.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	return nil
+}
+
+// SetRedirectMode chooses how DataNode redirects are handled, the default being RedirectPassthrough
+func (h *ProxyHandler) SetRedirectMode(mode RedirectMode) {
+	h.redirectMode = mode
+	if mode != RedirectPassthrough {
+		registerMetricsSource(h.redirects.String)
+	}
+}
+
+// redirectTransport asks the NameNode where the data lives and, in RedirectFollow mode,
+// sends the request body to the DataNode itself
+type redirectTransport struct {
+	next    http.RoundTripper
+	handler *ProxyHandler
+}
+
+func (t *redirectTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if t.handler.redirectMode != RedirectFollow || req.URL.Query().Get("noredirect") == "true" {
+		return t.next.RoundTrip(req)
+	}
+	event, err := ClassifyWebHDFSRequest(req)
+	if err != nil || !redirectedWebHDFSEvents[event] {
+		return t.next.RoundTrip(req)
+	}
+
+	// the NameNode only needs the request line, the data goes to the DataNode
+	nnReq := req.Clone(req.Context())
+	nnReq.Body = http.NoBody
+	nnReq.ContentLength = 0
+	nnReq.TransferEncoding = nil
+	nnReq.Header.Del("Expect")
+	res, err := t.next.RoundTrip(nnReq)
+	if err != nil || res.StatusCode != http.StatusTemporaryRedirect {
+		return res, err
+	}
+	location, err := res.Location()
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	if err != nil {
+		t.handler.redirects.failed.Add(1)
+		return nil, NewProxyError(http.StatusBadGateway, "IOException", "java.io.IOException",
+			fmt.Sprintf("NameNode sent a redirect without a valid Location: %s", err))
+	}
+	if t.handler.debug {
+		logger.Printf("following %s redirect to %s%s", event.Op(), location.Host, location.Path)
+	}
+
+	dnReq := req.Clone(req.Context())
+	dnReq.URL = location
+	dnReq.Host = location.Host
+	res, err = t.next.RoundTrip(dnReq)
+	if err != nil {
+		t.handler.redirects.failed.Add(1)
+		return nil, err
+	}
+	t.handler.redirects.followed.Add(1)
+	return res, nil
+}
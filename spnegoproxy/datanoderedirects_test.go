@@ -0,0 +1,251 @@
+package spnegoproxy
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// the delegation token the fake NameNode puts in its redirects
+const testNameNodeToken = "NNTOKEN"
+
+// fakeHDFS is a NameNode redirecting OPEN and CREATE to its DataNode, which records what reaches it
+type fakeHDFS struct {
+	nameNode *httptest.Server
+	dataNode *httptest.Server
+	mu       sync.Mutex
+	// query and body of the last request the DataNode got
+	dnQuery url.Values
+	dnBody  string
+	// whether the NameNode was sent a body
+	nnBody bool
+}
+
+func newFakeHDFS(t *testing.T) *fakeHDFS {
+	f := &fakeHDFS{}
+	f.dataNode = newTestBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		f.mu.Lock()
+		f.dnQuery, f.dnBody = r.URL.Query(), string(body)
+		f.mu.Unlock()
+		if r.Method == http.MethodPut {
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		io.WriteString(w, "data of "+r.URL.Path)
+	})
+	f.nameNode = newTestBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		f.mu.Lock()
+		f.nnBody = len(body) > 0
+		f.mu.Unlock()
+		location := f.location(r.URL.Path, r.URL.Query().Get("op"))
+		if r.URL.Query().Get("noredirect") == "true" {
+			json.NewEncoder(w).Encode(map[string]string{"Location": location})
+			return
+		}
+		http.Redirect(w, r, location, http.StatusTemporaryRedirect)
+	})
+	return f
+}
+
+// location is where the NameNode sends op on path
+func (f *fakeHDFS) location(path string, op string) string {
+	return f.dataNode.URL + path + "?op=" + op + "&namenoderpcaddress=nn:8020&delegation=" + testNameNodeToken + "&offset=0"
+}
+
+// lastDataNodeRequest gives the query and body the DataNode got last, and forgets them
+func (f *fakeHDFS) lastDataNodeRequest() (url.Values, string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	q, body := f.dnQuery, f.dnBody
+	f.dnQuery, f.dnBody = nil, ""
+	return q, body
+}
+
+// noFollow is a client giving redirects back instead of following them
+var noFollow = &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+
+func newRedirectProxy(t *testing.T, f *fakeHDFS, mode RedirectMode) (*ProxyHandler, *httptest.Server) {
+	h, proxy := newTestProxy(t, testHostPort(t, f.nameNode.URL))
+	h.redirectMode = mode
+	return h, proxy
+}
+
+func redirectOf(t *testing.T, rawURL string) *url.URL {
+	t.Helper()
+	res, err := noFollow.Get(rawURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusTemporaryRedirect {
+		t.Fatalf("status %d, want a redirect", res.StatusCode)
+	}
+	location, err := res.Location()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return location
+}
+
+func TestRedirectPassthrough(t *testing.T) {
+	f := newFakeHDFS(t)
+	_, proxy := newRedirectProxy(t, f, RedirectPassthrough)
+	location := redirectOf(t, proxy.URL+"/webhdfs/v1/a?op=OPEN")
+	if want := f.location("/webhdfs/v1/a", "OPEN"); location.String() != want {
+		t.Fatalf("redirect to %s, want %s", location, want)
+	}
+}
+
+func TestRedirectFollow(t *testing.T) {
+	f := newFakeHDFS(t)
+	_, proxy := newRedirectProxy(t, f, RedirectFollow)
+
+	res, err := noFollow.Get(proxy.URL + "/webhdfs/v1/a?op=OPEN")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || string(body) != "data of /webhdfs/v1/a" {
+		t.Fatalf("status %d, body %q", res.StatusCode, body)
+	}
+	if q, _ := f.lastDataNodeRequest(); q.Get("delegation") != testNameNodeToken || q.Get("offset") != "0" {
+		t.Fatalf("DataNode got %v", q)
+	}
+
+	// the data goes to the DataNode only
+	req, _ := http.NewRequest(http.MethodPut, proxy.URL+"/webhdfs/v1/b?op=CREATE", strings.NewReader("new data"))
+	if res, err = noFollow.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusCreated {
+		t.Fatalf("CREATE status %d", res.StatusCode)
+	}
+	if _, body := f.lastDataNodeRequest(); body != "new data" {
+		t.Fatalf("DataNode got %q", body)
+	}
+	f.mu.Lock()
+	nnBody := f.nnBody
+	f.mu.Unlock()
+	if nnBody {
+		t.Fatal("the NameNode was sent the data")
+	}
+
+	// other operations are left alone
+	res, err = noFollow.Get(proxy.URL + "/webhdfs/v1/a?op=OPEN&noredirect=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if q, _ := f.lastDataNodeRequest(); res.StatusCode != http.StatusOK || q != nil {
+		t.Fatalf("noredirect=true was followed: status %d, DataNode got %v", res.StatusCode, q)
+	}
+}
+
+func TestRedirectRewrite(t *testing.T) {
+	f := newFakeHDFS(t)
+	h, proxy := newRedirectProxy(t, f, RedirectRewrite)
+	dataNode := testHostPort(t, f.dataNode.URL).f()
+	proxyHost := testHostPort(t, proxy.URL).f()
+
+	location := redirectOf(t, proxy.URL+"/webhdfs/v1/a?op=OPEN")
+	q := location.Query()
+	if location.Host != proxyHost || location.Path != DATANODE_ROUTE_PREFIX+dataNode+"/webhdfs/v1/a" {
+		t.Fatalf("redirect to %s, want the DataNode route of %s on %s", location, dataNode, proxyHost)
+	}
+	if q.Has("delegation") || q.Get(DATANODE_TOKEN_PARAM) == "" || q.Get("offset") != "0" || q.Get("namenoderpcaddress") != "nn:8020" {
+		t.Fatalf("redirect query %v", q)
+	}
+
+	// the client cannot send a token of its own along
+	res, err := noFollow.Get(location.String() + "&delegation=FORGED")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK || string(body) != "data of /webhdfs/v1/a" {
+		t.Fatalf("status %d, body %q", res.StatusCode, body)
+	}
+	dnQuery, _ := f.lastDataNodeRequest()
+	if dnQuery.Has(DATANODE_TOKEN_PARAM) || len(dnQuery["delegation"]) != 1 || dnQuery.Get("delegation") != testNameNodeToken {
+		t.Fatalf("DataNode got %v", dnQuery)
+	}
+
+	// noredirect=true answers carry the Location in JSON
+	res, err = noFollow.Get(proxy.URL + "/webhdfs/v1/c?op=OPEN&noredirect=true")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var answer struct{ Location string }
+	json.NewDecoder(res.Body).Decode(&answer)
+	res.Body.Close()
+	if jsonLocation, err := url.Parse(answer.Location); err != nil || jsonLocation.Path != DATANODE_ROUTE_PREFIX+dataNode+"/webhdfs/v1/c" || jsonLocation.Query().Has("delegation") {
+		t.Fatalf("JSON Location %q", answer.Location)
+	}
+
+	// tokens are dropped after a while, the request then goes without one
+	h.dataNodes.mu.Lock()
+	for ref, token := range h.dataNodes.tokens {
+		token.added = token.added.Add(-DATANODE_TOKEN_TTL - time.Second)
+		h.dataNodes.tokens[ref] = token
+	}
+	h.dataNodes.mu.Unlock()
+	if res, err = noFollow.Get(location.String()); err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if dnQuery, _ = f.lastDataNodeRequest(); res.StatusCode != http.StatusOK || dnQuery.Has("delegation") || dnQuery.Has(DATANODE_TOKEN_PARAM) {
+		t.Fatalf("status %d, DataNode got %v with an expired reference", res.StatusCode, dnQuery)
+	}
+
+	// only DataNodes the NameNode recently redirected to can be reached
+	refused := []string{
+		proxy.URL + DATANODE_ROUTE_PREFIX + "127.0.0.1:1/webhdfs/v1/a?op=OPEN",
+		location.String(),
+	}
+	h.dataNodes.mu.Lock()
+	h.dataNodes.seen[dataNode] = time.Now().Add(-DATANODE_ROUTE_TTL - time.Second)
+	h.dataNodes.mu.Unlock()
+	for _, u := range refused {
+		res, err := noFollow.Get(u)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusForbidden {
+			t.Errorf("%s: status %d, want %d", u, res.StatusCode, http.StatusForbidden)
+		}
+		if re := readRemoteException(t, res); re.Exception != "AccessControlException" {
+			t.Errorf("%s: %s", u, re.Exception)
+		}
+	}
+	if q, _ := f.lastDataNodeRequest(); q != nil {
+		t.Fatalf("a refused route reached the DataNode with %v", q)
+	}
+}
+
+func TestDataNodeRouteNeedsRewriteMode(t *testing.T) {
+	f := newFakeHDFS(t)
+	for _, mode := range []RedirectMode{RedirectPassthrough, RedirectFollow} {
+		h, proxy := newRedirectProxy(t, f, mode)
+		dataNode := testHostPort(t, f.dataNode.URL).f()
+		h.dataNodes.allow(dataNode)
+		res, err := noFollow.Get(proxy.URL + DATANODE_ROUTE_PREFIX + dataNode + "/webhdfs/v1/a?op=OPEN")
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusForbidden {
+			t.Errorf("%s: status %d, want %d", mode, res.StatusCode, http.StatusForbidden)
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package spnegoproxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// how often the background loop checks whether the token is due for renewal
+const DELEGATION_TOKEN_CHECK_INTERVAL = time.Second * 10
+
+// how long we wait before asking for a delegation token again after failing to get one
+const DELEGATION_TOKEN_RETRY_INTERVAL = time.Second * 30
+
+// tokens whose expiry could not be learnt by renewing them are replaced after that long
+const DELEGATION_TOKEN_FALLBACK_LIFETIME = time.Hour * 1
+
+// how long the NameNode has to answer a delegation token operation
+const DELEGATION_TOKEN_CALL_TIMEOUT = time.Second * 30
+
+// delegationTokenManager gets an HDFS delegation token with SPNEGO and keeps renewing it in the background,
+// so that requests carry delegation= and the KDC is only needed for the token itself
+type delegationTokenManager struct {
+	mu        sync.Mutex
+	handler   *ProxyHandler
+	auth      http.RoundTripper
+	renewer   string
+	token     string
+	expiry    time.Time
+	renewAt   time.Time
+	lastError time.Time
+	// wakes the background loop up when the token got refused
+	wake     chan struct{}
+	fetched  atomic.Uint64
+	renewed  atomic.Uint64
+	failures atomic.Uint64
+	used     atomic.Uint64
+	rejected atomic.Uint64
+}
+
+func newDelegationTokenManager(h *ProxyHandler, renewer string) *delegationTokenManager {
+	m := &delegationTokenManager{
+		handler: h,
+		auth:    &spnegoTransport{next: h.upstream, handler: h, noDelegation: true},
+		renewer: renewer,
+		wake:    make(chan struct{}, 1),
+	}
+	registerMetricsSource(m.metrics)
+	return m
+}
+
+// get returns the current token, "" when there is no usable token yet
+func (m *delegationTokenManager) get() string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.token != "" && time.Now().Before(m.expiry) {
+		return m.token
+	}
+	return ""
+}
+
+// run gets and renews the token until the process ends, requests never wait for the NameNode
+func (m *delegationTokenManager) run() {
+	ticker := time.NewTicker(DELEGATION_TOKEN_CHECK_INTERVAL)
+	defer ticker.Stop()
+	for {
+		m.refresh()
+		select {
+		case <-ticker.C:
+		case <-m.wake:
+		}
+	}
+}
+
+// refresh renews the token, or gets a new one, when it is due
+func (m *delegationTokenManager) refresh() {
+	defer recoverPanic("refreshing the delegation token")
+	m.mu.Lock()
+	token, renewAt, lastError := m.token, m.renewAt, m.lastError
+	m.mu.Unlock()
+	now := time.Now()
+	if token != "" && now.Before(renewAt) {
+		return
+	}
+	if now.Sub(lastError) < DELEGATION_TOKEN_RETRY_INTERVAL {
+		return
+	}
+	if token != "" {
+		expiry, err := m.renew(token)
+		if err == nil {
+			m.renewed.Add(1)
+			m.mu.Lock()
+			// a backend may have refused the token meanwhile
+			if m.token == token {
+				m.setExpiry(now, expiry)
+			}
+			m.mu.Unlock()
+			return
+		}
+		m.failures.Add(1)
+		logger.Printf("Cannot renew the delegation token, getting a new one: %s", err)
+	}
+	token, err := m.fetch()
+	if err != nil {
+		m.failures.Add(1)
+		m.mu.Lock()
+		m.lastError = now
+		m.mu.Unlock()
+		logger.Printf("Cannot get a delegation token, using SPNEGO meanwhile: %s", err)
+		return
+	}
+	m.fetched.Add(1)
+	// renewing a fresh token is how we learn when it expires
+	expiry, err := m.renew(token)
+	m.mu.Lock()
+	m.token = token
+	if err == nil {
+		m.setExpiry(now, expiry)
+	} else {
+		logger.Printf("Cannot renew the new delegation token, replacing it in %s: %s", DELEGATION_TOKEN_FALLBACK_LIFETIME, err)
+		m.expiry = now.Add(DELEGATION_TOKEN_FALLBACK_LIFETIME)
+		m.renewAt = m.expiry
+	}
+	expiry = m.expiry
+	m.mu.Unlock()
+	logger.Printf("Got a delegation token expiring at %s", expiry.Format(time.RFC3339))
+}
+
+// setExpiry plans the next renewal half way to expiry, m.mu must be held
+func (m *delegationTokenManager) setExpiry(now time.Time, expiry time.Time) {
+	m.expiry = expiry
+	m.renewAt = now.Add(expiry.Sub(now) / 2)
+}
+
+// invalidate drops token after a backend refused it, and has the background loop get a new one
+func (m *delegationTokenManager) invalidate(token string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.token == token {
+		m.token = ""
+		select {
+		case m.wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (m *delegationTokenManager) fetch() (string, error) {
+	var answer struct {
+		Token struct {
+			URLString string `json:"urlString"`
+		}
+	}
+	if err := m.call(WebHDFSGetGetDelegationToken, url.Values{"renewer": {m.renewer}}, &answer); err != nil {
+		return "", err
+	}
+	if answer.Token.URLString == "" {
+		return "", errors.New("no token in the NameNode answer")
+	}
+	return answer.Token.URLString, nil
+}
+
+func (m *delegationTokenManager) renew(token string) (time.Time, error) {
+	var answer struct {
+		Long int64 `json:"long"`
+	}
+	if err := m.call(WebHDFSPutRenewDelegationToken, url.Values{"token": {token}}, &answer); err != nil {
+		return time.Time{}, err
+	}
+	if answer.Long <= 0 {
+		return time.Time{}, errors.New("no expiry in the NameNode answer")
+	}
+	return time.UnixMilli(answer.Long), nil
+}
+
+// call runs a WebHDFS operation on a backend of the pool, authenticated with SPNEGO
+func (m *delegationTokenManager) call(event WebHDFSEvent, query url.Values, answer any) error {
+	backend, err := m.handler.pool.Pick("")
+	if err != nil {
+		return err
+	}
+	query.Set("op", string(event.Op()))
+	u := url.URL{Scheme: m.handler.upstreamScheme, Host: backend.Address(), Path: "/webhdfs/v1/", RawQuery: query.Encode()}
+	ctx, cancel := context.WithTimeout(context.Background(), DELEGATION_TOKEN_CALL_TIMEOUT)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, event.Verb().String(), u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-agent", "hadoop-proxy/0.1")
+	res, err := m.auth.RoundTrip(req)
+	if err != nil {
+		return fmt.Errorf("%s on %s failed: %w", event.Op(), backend.Address(), err)
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return fmt.Errorf("%s on %s failed: %w", event.Op(), backend.Address(), err)
+	}
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s on %s answered %s: %s", event.Op(), backend.Address(), res.Status, bytes.TrimSpace(body))
+	}
+	if err := json.Unmarshal(body, answer); err != nil {
+		return fmt.Errorf("cannot parse %s answer: %w", event.Op(), err)
+	}
+	return nil
+}
+
+func (m *delegationTokenManager) metrics() string {
+	m.mu.Lock()
+	var expiry int64
+	if m.token != "" {
+		expiry = m.expiry.Unix()
+	}
+	m.mu.Unlock()
+	return fmt.Sprintf("delegation_token_expiry_timestamp %d\n", expiry) +
+		fmt.Sprintf("delegation_token_fetches_total %d\n", m.fetched.Load()) +
+		fmt.Sprintf("delegation_token_renewals_total %d\n", m.renewed.Load()) +
+		fmt.Sprintf("delegation_token_failures_total %d\n", m.failures.Load()) +
+		fmt.Sprintf("delegation_token_requests_total %d\n", m.used.Load()) +
+		fmt.Sprintf("delegation_token_rejected_total %d\n", m.rejected.Load())
+}
+
+// delegationTokenRejected tells whether res refuses the token of its request: WebHDFS answers 403
+// with an InvalidToken RemoteException when it expired or got cancelled
+func delegationTokenRejected(res *http.Response) bool {
+	switch res.StatusCode {
+	case http.StatusUnauthorized:
+		return true
+	case http.StatusForbidden:
+		body, _ := io.ReadAll(io.LimitReader(res.Body, 64<<10))
+		res.Body = struct {
+			io.Reader
+			io.Closer
+		}{io.MultiReader(bytes.NewReader(body), res.Body), res.Body}
+		return bytes.Contains(body, []byte("InvalidToken"))
+	default:
+		return false
+	}
+}
+
+// setDelegationToken makes req authenticate with token, replacing any the client sent
+func setDelegationToken(req *http.Request, token string) {
+	q := req.URL.Query()
+	q.Set("delegation", token)
+	req.URL.RawQuery = q.Encode()
+}
+
+// roundTripWithDelegationToken sends req with the managed delegation token. It returns a nil response
+// when there is no usable token or when the backend refused it and req can be sent again with SPNEGO.
+func (t *spnegoTransport) roundTripWithDelegationToken(req *http.Request) (*http.Response, error) {
+	m := t.handler.delegationTokens
+	token := m.get()
+	if token == "" {
+		return nil, nil
+	}
+	tokenReq := req.Clone(req.Context())
+	setDelegationToken(tokenReq, token)
+	m.used.Add(1)
+	res, err := t.next.RoundTrip(tokenReq)
+	if err != nil {
+		return nil, err
+	}
+	if !delegationTokenRejected(res) {
+		return res, nil
+	}
+	m.rejected.Add(1)
+	m.invalidate(token)
+	logger.Printf("%s refused our delegation token", req.URL.Host)
+	if !replayable(req) {
+		// the body is gone, let the client try again
+		return res, nil
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	return nil, nil
+}
+
+// EnableDelegationTokens makes requests authenticate with an HDFS delegation token the proxy gets and renews
+// with SPNEGO, renewer being the short name of the proxy principal when empty. The redirect mode must be set first.
+func (h *ProxyHandler) EnableDelegationTokens(renewer string) error {
+	if h.pool.registry == nil {
+		return errors.New("delegation tokens need Kerberos")
+	}
+	if h.impersonation != ImpersonateNone {
+		return fmt.Errorf("delegation tokens cannot be used with impersonation mode %s", h.impersonation)
+	}
+	if h.pool.registry.mutualAuthRequired() {
+		return errors.New("delegation tokens cannot be used with mutual authentication, backends would never prove their identity")
+	}
+	if renewer == "" {
+		renewer = h.pool.registry.shortName()
+	}
+	if h.redirectMode == RedirectPassthrough {
+		return fmt.Errorf("delegation tokens cannot be used with %s DataNode redirects, which hand the token to clients", RedirectPassthrough)
+	}
+	h.delegationTokens = newDelegationTokenManager(h, renewer)
+	go h.delegationTokens.run()
+	return nil
+}
+
+// shortName gives the first component of the proxy principal, which Hadoop expects as a token renewer
+func (r *SPNEGOClientRegistry) shortName() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	short, _, _ := strings.Cut(r.krbClient.Credentials.UserName(), "/")
+	return short
+}
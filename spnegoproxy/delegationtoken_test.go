@@ -0,0 +1,29 @@
+package spnegoproxy
+
+import "testing"
+
+func TestEnableDelegationTokensRefusals(t *testing.T) {
+	tests := []struct {
+		name          string
+		registry      *SPNEGOClientRegistry
+		redirectMode  RedirectMode
+		impersonation ImpersonationMode
+	}{
+		{"no kerberos", nil, RedirectRewrite, ImpersonateNone},
+		{"impersonation", &SPNEGOClientRegistry{}, RedirectRewrite, ImpersonateDoAs},
+		{"mutual authentication", &SPNEGOClientRegistry{mutualAuth: true}, RedirectRewrite, ImpersonateNone},
+		// the NameNode would hand our token to clients
+		{"passthrough redirects", &SPNEGOClientRegistry{}, RedirectPassthrough, ImpersonateNone},
+	}
+	for _, tt := range tests {
+		h := NewProxyHandler(NewBackendPool(RoundRobin, tt.registry), false)
+		h.redirectMode = tt.redirectMode
+		h.impersonation = tt.impersonation
+		if err := h.EnableDelegationTokens("proxy"); err == nil {
+			t.Errorf("%s: delegation tokens enabled", tt.name)
+		}
+		if h.delegationTokens != nil {
+			t.Errorf("%s: a delegation token manager was started", tt.name)
+		}
+	}
+}
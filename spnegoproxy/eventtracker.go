@@ -158,3 +158,23 @@ func handleRequestCallbacks(req *http.Request) {
 		requestInspectionCallback[i](req)
 	}
 }
+
+// RequestAdmissionCallback decides whether a client request may reach a backend, returning
+// the error to answer with when it may not
+type RequestAdmissionCallback func(*http.Request) *ProxyError
+
+var requestAdmissionCallback = []RequestAdmissionCallback{}
+
+func RegisterRequestAdmissionCallback(cb RequestAdmissionCallback) {
+	requestAdmissionCallback = append(requestAdmissionCallback, cb)
+}
+
+// handleAdmissionCallbacks returns the error of the first callback refusing req, nil when all admit it
+func handleAdmissionCallbacks(req *http.Request) *ProxyError {
+	for i := 0; i < len(requestAdmissionCallback); i++ {
+		if err := requestAdmissionCallback[i](req); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -4,6 +4,7 @@ go 1.23.1
 
 require (
 	github.com/hashicorp/consul/api v1.30.0
+	github.com/jcmturner/gofork v1.7.6
 	github.com/matchaxnb/gokrb5/v8 v8.4.5-prev2
 )
 
@@ -21,7 +22,6 @@ require (
 	github.com/hashicorp/serf v0.10.1 // indirect
 	github.com/jcmturner/aescts/v2 v2.0.0 // indirect
 	github.com/jcmturner/dnsutils/v2 v2.0.0 // indirect
-	github.com/jcmturner/gofork v1.7.6 // indirect
 	github.com/jcmturner/goidentity/v6 v6.0.1 // indirect
 	github.com/jcmturner/rpc/v2 v2.0.3 // indirect
 	github.com/mattn/go-colorable v0.1.13 // indirect
@@ -32,4 +32,4 @@ require (
 	golang.org/x/exp v0.0.0-20230817173708-d852ddb80c63 // indirect
 	golang.org/x/net v0.24.0 // indirect
 	golang.org/x/sys v0.19.0 // indirect
-)
\ No newline at end of file
+)
@@ -0,0 +1,175 @@
+package spnegoproxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// HealthCheckMode tells how backends are probed
+type HealthCheckMode string
+
+const (
+	// backends are only the ones consul or the command line gives
+	HealthCheckNone HealthCheckMode = "none"
+	// a WebHDFS call authenticated like client requests, which also catches Kerberos and auth filter failures
+	HealthCheckWebHDFS HealthCheckMode = "webhdfs"
+	// a TCP connection
+	HealthCheckTCP HealthCheckMode = "tcp"
+)
+
+func ParseHealthCheckMode(s string) (HealthCheckMode, error) {
+	switch mode := HealthCheckMode(strings.ToLower(s)); mode {
+	case HealthCheckNone, HealthCheckWebHDFS, HealthCheckTCP:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown health check mode %q (want one of %s, %s, %s)", s, HealthCheckNone, HealthCheckWebHDFS, HealthCheckTCP)
+	}
+}
+
+// HealthCheckSettings configures the active health checks of the backends
+type HealthCheckSettings struct {
+	Mode HealthCheckMode
+	// HDFS path and operation of webhdfs probes, e.g. / and GETFILESTATUS
+	Path     string
+	Op       string
+	Interval time.Duration
+	Timeout  time.Duration
+	// consecutive successes bringing a backend back, and failures taking it out
+	Rise int
+	Fall int
+}
+
+// backendHealth is what health checks found out about a backend, which is taken for healthy until probed
+type backendHealth struct {
+	down      atomic.Bool
+	successes int
+	failures  int
+	ok        atomic.Uint64
+	failed    atomic.Uint64
+}
+
+// record applies the outcome of a probe, with hysteresis
+func (bh *backendHealth) record(address string, err error, settings HealthCheckSettings) {
+	if err == nil {
+		bh.ok.Add(1)
+		bh.successes, bh.failures = bh.successes+1, 0
+		if bh.down.Load() && bh.successes >= settings.Rise {
+			logger.Printf("Backend %s is healthy again", address)
+			bh.down.Store(false)
+		}
+		return
+	}
+	bh.failed.Add(1)
+	bh.successes, bh.failures = 0, bh.failures+1
+	if !bh.down.Load() && bh.failures >= settings.Fall {
+		logger.Printf("Backend %s is unhealthy, taking it out: %s", address, err)
+		bh.down.Store(true)
+	}
+}
+
+func (bh *backendHealth) metrics(address string) string {
+	healthy := 1
+	if bh.down.Load() {
+		healthy = 0
+	}
+	return fmt.Sprintf("proxy_backend_healthy{backend=%q} %d\n", address, healthy) +
+		fmt.Sprintf("proxy_backend_health_checks_total{backend=%q,result=\"ok\"} %d\n", address, bh.ok.Load()) +
+		fmt.Sprintf("proxy_backend_health_checks_total{backend=%q,result=\"failed\"} %d\n", address, bh.failed.Load())
+}
+
+// EnableHealthChecks probes every backend of the pool in the background, unhealthy ones not being picked anymore
+func (h *ProxyHandler) EnableHealthChecks(settings HealthCheckSettings) error {
+	if settings.Mode == HealthCheckNone {
+		return nil
+	}
+	if settings.Interval <= 0 || settings.Timeout <= 0 {
+		return fmt.Errorf("health check interval and timeout must be positive")
+	}
+	if settings.Rise < 1 || settings.Fall < 1 {
+		return fmt.Errorf("health check rise and fall must be at least 1")
+	}
+	h.pool.healthChecked.Store(true)
+	logger.Printf("Checking backends with %s probes every %s", settings.Mode, settings.Interval)
+	go newHealthProber(h, settings).run(h.pool)
+	return nil
+}
+
+type healthProber struct {
+	settings HealthCheckSettings
+	auth     http.RoundTripper
+	scheme   string
+}
+
+// newHealthProber probes the backends of h the way h reaches them
+func newHealthProber(h *ProxyHandler, settings HealthCheckSettings) *healthProber {
+	return &healthProber{
+		settings: settings,
+		auth:     &spnegoTransport{next: h.upstream, handler: h, noCookie: true},
+		scheme:   h.upstreamScheme,
+	}
+}
+
+func (p *healthProber) run(pool *BackendPool) {
+	ticker := time.NewTicker(p.settings.Interval)
+	defer ticker.Stop()
+	for {
+		// a round ends before the next starts, so that each backend is probed by one goroutine at a time
+		p.round(pool)
+		<-ticker.C
+	}
+}
+
+// round probes every backend of the pool once
+func (p *healthProber) round(pool *BackendPool) {
+	var wg sync.WaitGroup
+	for _, b := range pool.Backends() {
+		wg.Add(1)
+		go func(b *Backend) {
+			defer wg.Done()
+			defer recoverPanic(fmt.Sprintf("probing backend %s", b.Address()))
+			b.health.record(b.Address(), p.probe(b), p.settings)
+		}(b)
+	}
+	wg.Wait()
+}
+
+func (p *healthProber) probe(b *Backend) error {
+	ctx, cancel := context.WithTimeout(context.Background(), p.settings.Timeout)
+	defer cancel()
+	if p.settings.Mode == HealthCheckTCP {
+		conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", b.Address())
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	u := url.URL{
+		Scheme:   p.scheme,
+		Host:     b.Address(),
+		Path:     WEBHDFS_PATH_PREFIX + p.settings.Path,
+		RawQuery: url.Values{"op": {p.settings.Op}}.Encode(),
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-agent", "hadoop-proxy/0.1")
+	res, err := p.auth.RoundTrip(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 1<<20))
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s %s answered %s", p.settings.Op, p.settings.Path, res.Status)
+	}
+	return nil
+}
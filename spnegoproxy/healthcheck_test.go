@@ -0,0 +1,96 @@
+package spnegoproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// pickedAddresses gives the backends n picks land on
+func pickedAddresses(t *testing.T, pool *BackendPool, n int) map[string]int {
+	t.Helper()
+	picked := map[string]int{}
+	for i := 0; i < n; i++ {
+		b, err := pool.Pick("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		picked[b.Address()]++
+	}
+	return picked
+}
+
+func TestHealthCheckHysteresis(t *testing.T) {
+	var status atomic.Int32
+	status.Store(http.StatusOK)
+	var probed atomic.Value
+	sick := newTestBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		probed.Store(r.URL.RequestURI())
+		w.WriteHeader(int(status.Load()))
+	})
+	healthy := newTestBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	h, _ := newTestProxy(t, testHostPort(t, sick.URL), testHostPort(t, healthy.URL))
+	settings := HealthCheckSettings{Mode: HealthCheckWebHDFS, Path: "/tmp", Op: "GETFILESTATUS", Timeout: time.Second, Rise: 2, Fall: 3}
+	prober := newHealthProber(h, settings)
+	sickAddress := testHostPort(t, sick.URL).f()
+
+	// each step is the answer of the sick backend to one round of probes, and whether it is down after it
+	steps := []struct {
+		status int
+		down   bool
+	}{
+		{http.StatusOK, false},
+		{http.StatusInternalServerError, false},
+		{http.StatusInternalServerError, false},
+		// a pass starts the count of failures over
+		{http.StatusOK, false},
+		{http.StatusServiceUnavailable, false},
+		{http.StatusServiceUnavailable, false},
+		{http.StatusForbidden, true},
+		{http.StatusOK, true},
+		// and a failure the count of passes
+		{http.StatusInternalServerError, true},
+		{http.StatusOK, true},
+		{http.StatusOK, false},
+	}
+	for i, step := range steps {
+		status.Store(int32(step.status))
+		prober.round(h.pool)
+		if down := backendAt(t, h.pool, sickAddress).health.down.Load(); down != step.down {
+			t.Fatalf("step %d (%d): down = %v, want %v", i+1, step.status, down, step.down)
+		}
+		picked := pickedAddresses(t, h.pool, 4)
+		if step.down && picked[sickAddress] > 0 {
+			t.Fatalf("step %d: a backend that is down was picked", i+1)
+		}
+		if !step.down && picked[sickAddress] != 2 {
+			t.Fatalf("step %d: a healthy backend got %d of 4 picks, want 2", i+1, picked[sickAddress])
+		}
+	}
+	if uri := probed.Load(); uri != "/webhdfs/v1/tmp?op=GETFILESTATUS" {
+		t.Errorf("probed %s", uri)
+	}
+	b := backendAt(t, h.pool, sickAddress)
+	if ok, failed := b.health.ok.Load(), b.health.failed.Load(); ok != 5 || failed != 6 {
+		t.Errorf("counted %d passes and %d failures, want 5 and 6", ok, failed)
+	}
+}
+
+func TestHealthCheckTCP(t *testing.T) {
+	up := newTestBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	// a port nothing listens on
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closedHost := testHostPort(t, closed.URL)
+	closed.Close()
+	h, _ := newTestProxy(t, testHostPort(t, up.URL), closedHost)
+	prober := newHealthProber(h, HealthCheckSettings{Mode: HealthCheckTCP, Timeout: time.Second, Rise: 1, Fall: 1})
+	prober.round(h.pool)
+	if backendAt(t, h.pool, testHostPort(t, up.URL).f()).health.down.Load() {
+		t.Error("a backend accepting connections is down")
+	}
+	if !backendAt(t, h.pool, closedHost.f()).health.down.Load() {
+		t.Error("a backend refusing connections is up")
+	}
+}
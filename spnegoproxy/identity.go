@@ -0,0 +1,203 @@
+package spnegoproxy
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// IdentityResolver finds the end user behind a client request, from its verified TLS client certificate,
+// from an API key or from a header set by a trusted ingress
+type IdentityResolver struct {
+	fromClientCert bool
+	header         string
+	trustedFrom    []*net.IPNet
+	apiKeyHeader   string
+	apiKeys        map[string]string
+}
+
+// NewIdentityResolver builds a resolver. The header is only believed for clients in the trustedFrom
+// comma separated CIDR list, or from anywhere when that list is empty, which impersonation refuses.
+func NewIdentityResolver(fromClientCert bool, header string, trustedFrom string) (*IdentityResolver, error) {
+	i := &IdentityResolver{fromClientCert: fromClientCert, header: http.CanonicalHeaderKey(header)}
+	for _, cidr := range strings.Split(trustedFrom, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted network %q: %w", cidr, err)
+		}
+		i.trustedFrom = append(i.trustedFrom, ipNet)
+	}
+	if header != "" && len(i.trustedFrom) == 0 {
+		logger.Printf("Trusting the %s header from any client, only do this behind an ingress that sets it", i.header)
+	}
+	return i, nil
+}
+
+// SetAPIKeys maps the API keys clients send in header to user names, keysFile being a JSON object
+// of key to user name
+func (i *IdentityResolver) SetAPIKeys(header string, keysFile string) error {
+	b, err := os.ReadFile(keysFile)
+	if err != nil {
+		return fmt.Errorf("cannot read API keys: %w", err)
+	}
+	var keys map[string]string
+	if err := json.Unmarshal(b, &keys); err != nil {
+		return fmt.Errorf("cannot parse API keys file %s: %w", keysFile, err)
+	}
+	for key, user := range keys {
+		if key == "" || user == "" {
+			return fmt.Errorf("API keys file %s has an empty key or user name", keysFile)
+		}
+	}
+	i.apiKeyHeader = http.CanonicalHeaderKey(header)
+	i.apiKeys = keys
+	logger.Printf("Loaded %d API keys from %s", len(keys), keysFile)
+	return nil
+}
+
+// Resolve returns the end user name, empty when the request does not carry any
+func (i *IdentityResolver) Resolve(r *http.Request) string {
+	if i.fromClientCert && r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		if cn := r.TLS.VerifiedChains[0][0].Subject.CommonName; cn != "" {
+			return cn
+		}
+	}
+	if i.apiKeyHeader != "" {
+		if key := r.Header.Get(i.apiKeyHeader); key != "" {
+			// a wrong key must not fall back to a header the client may set as well
+			return i.apiKeys[key]
+		}
+	}
+	if i.header != "" && i.trusts(r.RemoteAddr) {
+		return strings.TrimSpace(r.Header.Get(i.header))
+	}
+	return ""
+}
+
+func (i *IdentityResolver) trusts(remoteAddr string) bool {
+	if len(i.trustedFrom) == 0 {
+		return true
+	}
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		host = remoteAddr
+	}
+	ip := net.ParseIP(host)
+	for _, ipNet := range i.trustedFrom {
+		if ip != nil && ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// scrub removes what the resolver reads from the request sent to the backend
+func (i *IdentityResolver) scrub(req *http.Request) {
+	if i.header != "" {
+		req.Header.Del(i.header)
+	}
+	if i.apiKeyHeader != "" {
+		req.Header.Del(i.apiKeyHeader)
+	}
+}
+
+// checkTrusted tells why the end users the resolver finds cannot be acted as: a header believed
+// from any client lets every client be whoever it likes
+func (i *IdentityResolver) checkTrusted() error {
+	if i.header != "" && len(i.trustedFrom) == 0 {
+		return fmt.Errorf("the %s header is believed from any client, give the networks it may come from", i.header)
+	}
+	if !i.fromClientCert && i.apiKeyHeader == "" && i.header == "" {
+		return errors.New("no client certificate, API key or trusted header identifies end users")
+	}
+	return nil
+}
+
+func identityFromContext(ctx context.Context) string {
+	identity, _ := ctx.Value(identityContextKey).(string)
+	return identity
+}
+
+// RequestIdentity gives the end user of a request handed to admission callbacks, empty when unknown
+func RequestIdentity(r *http.Request) string {
+	return identityFromContext(r.Context())
+}
+
+// ImpersonationMode tells how the proxy makes backends see the end user rather than its own principal
+type ImpersonationMode string
+
+const (
+	// every request is made as the proxy principal
+	ImpersonateNone ImpersonationMode = "none"
+	// service tickets are obtained on behalf of the end user with S4U2Self and S4U2Proxy
+	ImpersonateS4U ImpersonationMode = "s4u"
+	// the proxy principal, set up as a Hadoop proxy user, asks for the end user with doas=
+	ImpersonateDoAs ImpersonationMode = "doas"
+)
+
+func ParseImpersonationMode(s string) (ImpersonationMode, error) {
+	switch mode := ImpersonationMode(strings.ToLower(s)); mode {
+	case ImpersonateNone, ImpersonateS4U, ImpersonateDoAs:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown impersonation mode %q (want one of %s, %s, %s)", s, ImpersonateNone, ImpersonateS4U, ImpersonateDoAs)
+	}
+}
+
+// SetIdentityResolver makes the handler find out the end user of every request
+func (h *ProxyHandler) SetIdentityResolver(resolver *IdentityResolver) {
+	h.identity = resolver
+}
+
+// SetImpersonation makes requests reach the backends as their end user, which needs an identity resolver
+// that clients cannot fool. Requests without an end user are refused.
+func (h *ProxyHandler) SetImpersonation(mode ImpersonationMode) error {
+	if mode == ImpersonateNone {
+		h.impersonation = mode
+		return nil
+	}
+	if h.identity == nil {
+		return fmt.Errorf("impersonation mode %s needs a way to identify end users", mode)
+	}
+	if err := h.identity.checkTrusted(); err != nil {
+		return fmt.Errorf("impersonation mode %s: %w", mode, err)
+	}
+	if h.delegationTokens != nil {
+		return fmt.Errorf("impersonation mode %s cannot be used with delegation tokens", mode)
+	}
+	if mode == ImpersonateS4U {
+		if h.pool.registry == nil {
+			return fmt.Errorf("impersonation mode %s needs Kerberos", mode)
+		}
+		h.pool.registry.EnableS4U()
+	}
+	h.impersonation = mode
+	return nil
+}
+
+// impersonate makes req, on its way to the backend, act as identity. Whatever doas the client asked for
+// is dropped, as it would otherwise run with the rights of the proxy principal.
+func (h *ProxyHandler) impersonate(req *http.Request, identity string) {
+	if h.impersonation == ImpersonateNone {
+		return
+	}
+	q := req.URL.Query()
+	for k := range q {
+		// WebHDFS parameter names are case insensitive
+		if strings.EqualFold(k, "doas") {
+			q.Del(k)
+		}
+	}
+	if h.impersonation == ImpersonateDoAs {
+		q.Set("doas", identity)
+	}
+	req.URL.RawQuery = q.Encode()
+}
@@ -0,0 +1,418 @@
+package spnegoproxy
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/matchaxnb/gokrb5/v8/client"
+	"github.com/matchaxnb/gokrb5/v8/config"
+	"github.com/matchaxnb/gokrb5/v8/credentials"
+	"github.com/matchaxnb/gokrb5/v8/iana/nametype"
+	"github.com/matchaxnb/gokrb5/v8/keytab"
+	"github.com/matchaxnb/gokrb5/v8/types"
+)
+
+// how often the credential files and the TGT validity are checked
+const CREDENTIAL_CHECK_INTERVAL = time.Second * 30
+
+// how long before its expiry the TGT is replaced, at most a quarter of its lifetime
+const TGT_REFRESH_MARGIN = time.Minute * 15
+
+// how long a replaced Kerberos client is kept alive for the requests still using it
+const KRB_CLIENT_SWAP_GRACE = time.Minute * 1
+
+// credentialSource builds logged in Kerberos clients out of files
+type credentialSource interface {
+	// a logged in client along with the validity of its TGT
+	newClient() (*client.Client, krbSessionTimes, error)
+	// the files the client depends on, a change in any of them means a new client is needed
+	files() []string
+	// whether the TGT can be acquired again by the source, rather than only re-read
+	canLogin() bool
+	String() string
+}
+
+// CredentialManager keeps a logged in Kerberos client, getting a new TGT before the current one expires
+// and building a new client when the files it comes from change
+type CredentialManager struct {
+	source    credentialSource
+	current   atomic.Pointer[client.Client]
+	tgt       atomic.Pointer[krbSessionTimes]
+	mu        sync.Mutex
+	onChange  []func(*client.Client)
+	checksums map[string][32]byte
+	logins    atomic.Uint64
+	failures  atomic.Uint64
+	lastLogin atomic.Int64
+}
+
+func newCredentialManager(source credentialSource) (*CredentialManager, error) {
+	m := &CredentialManager{source: source}
+	checksums, err := m.fileChecksums()
+	if err != nil {
+		return nil, err
+	}
+	cl, tgt, err := source.newClient()
+	if err != nil {
+		return nil, err
+	}
+	m.checksums = checksums
+	m.current.Store(cl)
+	m.tgt.Store(&tgt)
+	m.logins.Add(1)
+	m.lastLogin.Store(time.Now().Unix())
+	registerMetricsSource(m.metrics)
+	return m, nil
+}
+
+// NewCCacheCredentialManager uses the TGT of an MIT credential cache, such as one kept up to date by a
+// kinit sidecar, reading it again when it changes. ccache may be given as in KRB5CCNAME, FILE:<path>.
+func NewCCacheCredentialManager(ccache string, cfgFile string) (*CredentialManager, error) {
+	path := ccache
+	if kind, rest, ok := strings.Cut(ccache, ":"); ok && len(kind) > 1 {
+		if kind != "FILE" {
+			return nil, fmt.Errorf("unsupported credential cache type %s, only FILE caches can be read", kind)
+		}
+		path = rest
+	}
+	return newCredentialManager(&ccacheSource{path: path, cfgFile: cfgFile})
+}
+
+// NewPasswordCredentialManager logs user@realm in with a password read from passwordFile, or else from
+// the passwordEnv environment variable. The password file is watched for changes like krb5.conf.
+func NewPasswordCredentialManager(user string, realm string, passwordFile string, passwordEnv string, cfgFile string) (*CredentialManager, error) {
+	if passwordFile == "" && passwordEnv == "" {
+		return nil, errors.New("a password file or environment variable is needed")
+	}
+	return newCredentialManager(&passwordSource{user: user, realm: realm, passwordFile: passwordFile, passwordEnv: passwordEnv, cfgFile: cfgFile})
+}
+
+// NewKeytabCredentialManager logs user@realm in with a keytab, watching it and krb5.conf for changes
+func NewKeytabCredentialManager(user string, realm string, keytabFile string, cfgFile string) (*CredentialManager, error) {
+	return newCredentialManager(&keytabSource{user: user, realm: realm, keytabFile: keytabFile, cfgFile: cfgFile})
+}
+
+// Client returns the Kerberos client to use right now
+func (m *CredentialManager) Client() *client.Client {
+	return m.current.Load()
+}
+
+// OnClientChange registers a function called with every new Kerberos client
+func (m *CredentialManager) OnClientChange(f func(*client.Client)) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onChange = append(m.onChange, f)
+}
+
+// Run checks the credentials every CREDENTIAL_CHECK_INTERVAL until stop is closed
+func (m *CredentialManager) Run(stop <-chan struct{}) {
+	ticker := time.NewTicker(CREDENTIAL_CHECK_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			m.check()
+		}
+	}
+}
+
+func (m *CredentialManager) check() {
+	checksums, err := m.fileChecksums()
+	if err != nil {
+		// files being rotated may be missing for a moment, the current client is still good
+		logger.Printf("Cannot check %s: %s", m.source, err)
+		return
+	}
+	m.mu.Lock()
+	changed := false
+	for f, sum := range checksums {
+		changed = changed || m.checksums[f] != sum
+	}
+	m.mu.Unlock()
+	if changed {
+		logger.Printf("Credential files of %s changed, loading them again", m.source)
+		m.refresh(checksums)
+		return
+	}
+	if time.Now().After(m.tgt.Load().refreshTime()) {
+		if !m.source.canLogin() {
+			m.reportExpiry()
+			return
+		}
+		logger.Printf("TGT of %s is missing or about to expire, logging in again", m.source)
+		m.refresh(checksums)
+	}
+}
+
+// refresh builds a new client and swaps it in, keeping the current one when that fails
+func (m *CredentialManager) refresh(checksums map[string][32]byte) {
+	cl, tgt, err := m.source.newClient()
+	if err != nil {
+		m.failures.Add(1)
+		logger.Printf("Keeping the current Kerberos client, cannot log %s in: %s", m.source, err)
+		return
+	}
+	m.logins.Add(1)
+	m.lastLogin.Store(time.Now().Unix())
+	m.mu.Lock()
+	m.checksums = checksums
+	onChange := append([]func(*client.Client){}, m.onChange...)
+	m.mu.Unlock()
+	old := m.current.Swap(cl)
+	m.tgt.Store(&tgt)
+	for _, f := range onChange {
+		f(cl)
+	}
+	time.AfterFunc(KRB_CLIENT_SWAP_GRACE, old.Destroy)
+}
+
+func (m *CredentialManager) fileChecksums() (map[string][32]byte, error) {
+	checksums := make(map[string][32]byte)
+	for _, f := range m.source.files() {
+		b, err := os.ReadFile(f)
+		if err != nil {
+			return nil, err
+		}
+		checksums[f] = sha256.Sum256(b)
+	}
+	return checksums, nil
+}
+
+// reportExpiry warns about a TGT the source cannot acquire again by itself
+func (m *CredentialManager) reportExpiry() {
+	tgt := m.tgt.Load()
+	if time.Now().After(tgt.EndTime) {
+		logger.Printf("TGT of %s expired at %s, requests will fail until new credentials show up", m.source, tgt.EndTime.Format(time.RFC3339))
+	} else {
+		logger.Printf("TGT of %s expires at %s and cannot be acquired again, waiting for new credentials", m.source, tgt.EndTime.Format(time.RFC3339))
+	}
+}
+
+// krbSessionTimes is the validity of a TGT, recorded when it is acquired as gokrb5 keeps it to itself
+type krbSessionTimes struct {
+	Realm     string
+	AuthTime  time.Time
+	EndTime   time.Time
+	RenewTill time.Time
+}
+
+// loginTimes gives the validity of the TGT cl just got, which is what krb5.conf asks for at most.
+// A KDC granting less only makes us log in later than planned: gokrb5 renews such a TGT itself.
+func loginTimes(cl *client.Client, authTime time.Time) krbSessionTimes {
+	tgt := krbSessionTimes{
+		Realm:    cl.Credentials.Domain(),
+		AuthTime: authTime,
+		EndTime:  authTime.Add(cl.Config.LibDefaults.TicketLifetime),
+	}
+	if renew := cl.Config.LibDefaults.RenewLifetime; renew > 0 {
+		tgt.RenewTill = authTime.Add(renew)
+	}
+	return tgt
+}
+
+// refreshTime tells when the TGT should be replaced
+func (s *krbSessionTimes) refreshTime() time.Time {
+	margin := TGT_REFRESH_MARGIN
+	if lifetime := s.EndTime.Sub(s.AuthTime); lifetime/4 < margin {
+		margin = lifetime / 4
+	}
+	return s.EndTime.Add(-margin)
+}
+
+func (m *CredentialManager) metrics() string {
+	var sb strings.Builder
+	cl := m.Client()
+	tgt := m.tgt.Load()
+	sb.WriteString(fmt.Sprintf("krb_tgt_expiry_timestamp{realm=%q} %d\n", tgt.Realm, tgt.EndTime.Unix()))
+	if !tgt.RenewTill.IsZero() {
+		sb.WriteString(fmt.Sprintf("krb_tgt_renew_till_timestamp{realm=%q} %d\n", tgt.Realm, tgt.RenewTill.Unix()))
+	}
+	expired := 0
+	if time.Now().After(tgt.EndTime) {
+		expired = 1
+	}
+	sb.WriteString(fmt.Sprintf("krb_tgt_expired %d\n", expired))
+	sb.WriteString(fmt.Sprintf("krb_logins_total %d\n", m.logins.Load()))
+	sb.WriteString(fmt.Sprintf("krb_login_failures_total %d\n", m.failures.Load()))
+	sb.WriteString(fmt.Sprintf("krb_last_login_timestamp %d\n", m.lastLogin.Load()))
+	if cl.Credentials.HasKeytab() {
+		sb.WriteString(fmt.Sprintf("krb_keytab_kvno %d\n", keytabKVNO(cl.Credentials.Keytab(), cl.Credentials.UserName(), cl.Credentials.Domain())))
+	}
+	return sb.String()
+}
+
+// loadKrb5Files reads a keytab and a krb5.conf, directives gokrb5 does not support are ignored
+func loadKrb5Files(keytabFile string, cfgFile string) (*keytab.Keytab, *config.Config, error) {
+	kt, err := keytab.Load(keytabFile)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot read keytab: %w", err)
+	}
+	conf, err := loadKrb5Config(cfgFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	return kt, conf, nil
+}
+
+func loadKrb5Config(cfgFile string) (*config.Config, error) {
+	conf, err := config.Load(cfgFile)
+	unsupErr := config.UnsupportedDirective{}
+	if err != nil && !errors.As(err, &unsupErr) {
+		return nil, fmt.Errorf("bad config: %w", err)
+	}
+	return conf, nil
+}
+
+// keytabKVNO is the highest key version the keytab holds for user@realm
+func keytabKVNO(kt *keytab.Keytab, user string, realm string) uint32 {
+	var kvno uint32
+	for _, e := range kt.Entries {
+		if e.Principal.Realm == realm && strings.Join(e.Principal.Components, "/") == user && e.KVNO > kvno {
+			kvno = e.KVNO
+		}
+	}
+	return kvno
+}
+
+type keytabSource struct {
+	user       string
+	realm      string
+	keytabFile string
+	cfgFile    string
+}
+
+func (s *keytabSource) newClient() (*client.Client, krbSessionTimes, error) {
+	kt, conf, err := loadKrb5Files(s.keytabFile, s.cfgFile)
+	if err != nil {
+		return nil, krbSessionTimes{}, err
+	}
+	cl := client.NewWithKeytab(s.user, s.realm, kt, conf, client.Logger(logger), client.DisablePAFXFAST(false))
+	authTime := time.Now()
+	if err := cl.Login(); err != nil {
+		return nil, krbSessionTimes{}, fmt.Errorf("cannot log in: %w", err)
+	}
+	logger.Printf("Logged in as %s@%s with keytab %s (kvno %d)", s.user, s.realm, s.keytabFile, keytabKVNO(kt, s.user, s.realm))
+	return cl, loginTimes(cl, authTime), nil
+}
+
+func (s *keytabSource) files() []string {
+	return []string{s.keytabFile, s.cfgFile}
+}
+
+func (s *keytabSource) canLogin() bool {
+	return true
+}
+
+func (s *keytabSource) String() string {
+	return fmt.Sprintf("%s@%s (keytab %s)", s.user, s.realm, s.keytabFile)
+}
+
+type ccacheSource struct {
+	path    string
+	cfgFile string
+}
+
+func (s *ccacheSource) newClient() (*client.Client, krbSessionTimes, error) {
+	conf, err := loadKrb5Config(s.cfgFile)
+	if err != nil {
+		return nil, krbSessionTimes{}, err
+	}
+	cc, err := credentials.LoadCCache(s.path)
+	if err != nil {
+		return nil, krbSessionTimes{}, fmt.Errorf("cannot read credential cache %s: %w", s.path, err)
+	}
+	cl, err := client.NewFromCCache(cc, conf, client.Logger(logger), client.DisablePAFXFAST(false))
+	if err != nil {
+		return nil, krbSessionTimes{}, fmt.Errorf("cannot use credential cache %s: %w", s.path, err)
+	}
+	realm := cc.GetClientRealm()
+	// NewFromCCache found the TGT already
+	cred, _ := cc.GetEntry(types.PrincipalName{NameType: nametype.KRB_NT_SRV_INST, NameString: []string{"krbtgt", realm}})
+	tgt := krbSessionTimes{Realm: realm, AuthTime: cred.AuthTime, EndTime: cred.EndTime, RenewTill: cred.RenewTill}
+	if time.Now().After(tgt.EndTime) {
+		return nil, krbSessionTimes{}, fmt.Errorf("the TGT in credential cache %s expired at %s", s.path, tgt.EndTime.Format(time.RFC3339))
+	}
+	logger.Printf("Using the TGT of %s@%s from credential cache %s, valid until %s",
+		cl.Credentials.UserName(), cl.Credentials.Domain(), s.path, tgt.EndTime.Format(time.RFC3339))
+	return cl, tgt, nil
+}
+
+func (s *ccacheSource) files() []string {
+	return []string{s.path, s.cfgFile}
+}
+
+func (s *ccacheSource) canLogin() bool {
+	return false
+}
+
+func (s *ccacheSource) String() string {
+	return fmt.Sprintf("credential cache %s", s.path)
+}
+
+type passwordSource struct {
+	user         string
+	realm        string
+	passwordFile string
+	passwordEnv  string
+	cfgFile      string
+}
+
+// password reads the secret, which must never end up in logs or errors
+func (s *passwordSource) password() (string, error) {
+	if s.passwordFile != "" {
+		b, err := os.ReadFile(s.passwordFile)
+		if err != nil {
+			return "", fmt.Errorf("cannot read password file: %w", err)
+		}
+		return strings.TrimRight(string(b), "\r\n"), nil
+	}
+	password, ok := os.LookupEnv(s.passwordEnv)
+	if !ok {
+		return "", fmt.Errorf("environment variable %s is not set", s.passwordEnv)
+	}
+	return password, nil
+}
+
+func (s *passwordSource) newClient() (*client.Client, krbSessionTimes, error) {
+	conf, err := loadKrb5Config(s.cfgFile)
+	if err != nil {
+		return nil, krbSessionTimes{}, err
+	}
+	password, err := s.password()
+	if err != nil {
+		return nil, krbSessionTimes{}, err
+	}
+	if password == "" {
+		return nil, krbSessionTimes{}, fmt.Errorf("empty password for %s@%s", s.user, s.realm)
+	}
+	cl := client.NewWithPassword(s.user, s.realm, password, conf, client.Logger(logger), client.DisablePAFXFAST(false))
+	authTime := time.Now()
+	if err := cl.Login(); err != nil {
+		return nil, krbSessionTimes{}, fmt.Errorf("cannot log in: %w", err)
+	}
+	logger.Printf("Logged in as %s@%s with a password", s.user, s.realm)
+	return cl, loginTimes(cl, authTime), nil
+}
+
+func (s *passwordSource) files() []string {
+	if s.passwordFile != "" {
+		return []string{s.passwordFile, s.cfgFile}
+	}
+	return []string{s.cfgFile}
+}
+
+func (s *passwordSource) canLogin() bool {
+	return true
+}
+
+func (s *passwordSource) String() string {
+	return fmt.Sprintf("%s@%s (password)", s.user, s.realm)
+}
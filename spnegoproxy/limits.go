@@ -0,0 +1,151 @@
+package spnegoproxy
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// limitListener accepts at most max client connections at once, later ones wait in the kernel backlog
+type limitListener struct {
+	net.Listener
+	slots     chan struct{}
+	accepted  atomic.Uint64
+	waits     atomic.Uint64
+	waitNanos atomic.Uint64
+}
+
+// LimitListener caps the number of client connections open at once, l is returned as is when max is not positive
+func LimitListener(l net.Listener, max int) net.Listener {
+	if max <= 0 {
+		return l
+	}
+	ll := &limitListener{Listener: l, slots: make(chan struct{}, max)}
+	registerMetricsSource(ll.metrics)
+	logger.Printf("Accepting at most %d client connections", max)
+	return ll
+}
+
+func (l *limitListener) Accept() (net.Conn, error) {
+	select {
+	case l.slots <- struct{}{}:
+	default:
+		// the kernel does not tell how long each connection sat in the backlog, record how long we left them there
+		start := time.Now()
+		l.slots <- struct{}{}
+		l.waits.Add(1)
+		l.waitNanos.Add(uint64(time.Since(start)))
+	}
+	c, err := l.Listener.Accept()
+	if err != nil {
+		<-l.slots
+		return nil, err
+	}
+	l.accepted.Add(1)
+	return &limitConn{Conn: c, release: func() { <-l.slots }}, nil
+}
+
+func (l *limitListener) metrics() string {
+	return fmt.Sprintf("proxy_client_connections %d\n", len(l.slots)) +
+		fmt.Sprintf("proxy_client_connections_max %d\n", cap(l.slots)) +
+		fmt.Sprintf("proxy_client_connections_total %d\n", l.accepted.Load()) +
+		fmt.Sprintf("proxy_client_connection_wait_seconds_sum %f\n", time.Duration(l.waitNanos.Load()).Seconds()) +
+		fmt.Sprintf("proxy_client_connection_wait_seconds_count %d\n", l.waits.Load())
+}
+
+type limitConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitConn) Close() error {
+	err := c.Conn.Close()
+	c.once.Do(c.release)
+	return err
+}
+
+// concurrencyLimiter lets a bounded number of requests reach the backends at once, the next ones
+// wait in a bounded queue for a while
+type concurrencyLimiter struct {
+	slots        chan struct{}
+	maxQueue     int64
+	queueTimeout time.Duration
+	queued       atomic.Int64
+	waits        atomic.Uint64
+	waitNanos    atomic.Uint64
+	rejected     atomic.Uint64
+	timedOut     atomic.Uint64
+}
+
+// acquire waits for a slot, which must be given back with release
+func (l *concurrencyLimiter) acquire(ctx context.Context) *ProxyError {
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	default:
+	}
+	if l.queued.Add(1) > l.maxQueue {
+		l.queued.Add(-1)
+		l.rejected.Add(1)
+		return l.overloaded("the proxy queue is full")
+	}
+	defer l.queued.Add(-1)
+	start := time.Now()
+	timer := time.NewTimer(l.queueTimeout)
+	defer timer.Stop()
+	defer func() {
+		l.waits.Add(1)
+		l.waitNanos.Add(uint64(time.Since(start)))
+	}()
+	select {
+	case l.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		l.timedOut.Add(1)
+		return l.overloaded(fmt.Sprintf("no backend slot freed up in %s", l.queueTimeout))
+	case <-ctx.Done():
+		return NewProxyError(http.StatusServiceUnavailable, "IOException", "java.io.IOException", ctx.Err().Error())
+	}
+}
+
+func (l *concurrencyLimiter) release() {
+	<-l.slots
+}
+
+func (l *concurrencyLimiter) overloaded(why string) *ProxyError {
+	proxyErr := NewProxyError(http.StatusServiceUnavailable, "RetriableException", "org.apache.hadoop.ipc.RetriableException",
+		fmt.Sprintf("Proxy overloaded, %s", why))
+	proxyErr.RetryAfter = time.Second
+	return proxyErr
+}
+
+func (l *concurrencyLimiter) metrics() string {
+	return fmt.Sprintf("proxy_inflight_requests %d\n", len(l.slots)) +
+		fmt.Sprintf("proxy_inflight_requests_max %d\n", cap(l.slots)) +
+		fmt.Sprintf("proxy_queued_requests %d\n", l.queued.Load()) +
+		fmt.Sprintf("proxy_queue_wait_seconds_sum %f\n", time.Duration(l.waitNanos.Load()).Seconds()) +
+		fmt.Sprintf("proxy_queue_wait_seconds_count %d\n", l.waits.Load()) +
+		fmt.Sprintf("proxy_queue_rejected_total{reason=\"full\"} %d\n", l.rejected.Load()) +
+		fmt.Sprintf("proxy_queue_rejected_total{reason=\"timeout\"} %d\n", l.timedOut.Load())
+}
+
+// SetConcurrencyLimit lets at most maxInFlight requests reach the backends at once, up to maxQueue more
+// waiting at most queueTimeout for their turn, the others being answered with a 503
+func (h *ProxyHandler) SetConcurrencyLimit(maxInFlight int, maxQueue int, queueTimeout time.Duration) {
+	if maxInFlight <= 0 {
+		h.inFlight = nil
+		return
+	}
+	h.inFlight = &concurrencyLimiter{
+		slots:        make(chan struct{}, maxInFlight),
+		maxQueue:     int64(maxQueue),
+		queueTimeout: queueTimeout,
+	}
+	registerMetricsSource(h.inFlight.metrics)
+	logger.Printf("Sending at most %d requests to the backends at once, queueing up to %d", maxInFlight, maxQueue)
+}
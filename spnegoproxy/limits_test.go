@@ -0,0 +1,88 @@
+package spnegoproxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestLimitListenerRecordsWaits(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := LimitListener(inner, 1).(*limitListener)
+	defer l.Close()
+	dial := func() net.Conn {
+		c, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { c.Close() })
+		return c
+	}
+	dial()
+	first, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l.waits.Load() != 0 {
+		t.Fatalf("waits = %d with a free slot, want 0", l.waits.Load())
+	}
+	dial()
+	accepted := make(chan net.Conn)
+	go func() {
+		c, _ := l.Accept()
+		accepted <- c
+	}()
+	const held = 100 * time.Millisecond
+	select {
+	case <-accepted:
+		t.Fatal("a second connection was accepted over the cap")
+	case <-time.After(held):
+	}
+	first.Close()
+	// closing twice gives the slot back once
+	first.Close()
+	second := <-accepted
+	defer second.Close()
+	if waits, waited := l.waits.Load(), time.Duration(l.waitNanos.Load()); waits != 1 || waited < held {
+		t.Fatalf("waits = %d for %s, want 1 of at least %s", waits, waited, held)
+	}
+	if len(l.slots) != 1 {
+		t.Fatalf("%d slots taken, want 1", len(l.slots))
+	}
+}
+
+func TestConcurrencyLimiterQueue(t *testing.T) {
+	l := &concurrencyLimiter{slots: make(chan struct{}, 1), maxQueue: 1, queueTimeout: 100 * time.Millisecond}
+	ctx := context.Background()
+	if proxyErr := l.acquire(ctx); proxyErr != nil {
+		t.Fatalf("free slot refused: %s", proxyErr)
+	}
+	// the queued request times out
+	if proxyErr := l.acquire(ctx); proxyErr == nil || proxyErr.Exception != "RetriableException" {
+		t.Fatalf("queued request got %v, want a RetriableException", proxyErr)
+	}
+	if l.timedOut.Load() != 1 || l.waits.Load() != 1 || time.Duration(l.waitNanos.Load()) < l.queueTimeout {
+		t.Fatalf("timed out %d, waits %d for %s", l.timedOut.Load(), l.waits.Load(), time.Duration(l.waitNanos.Load()))
+	}
+	// one waits for the slot, the next finds the queue full
+	got := make(chan *ProxyError)
+	go func() { got <- l.acquire(ctx) }()
+	for l.queued.Load() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+	if proxyErr := l.acquire(ctx); proxyErr == nil || proxyErr.StatusCode != http.StatusServiceUnavailable || l.rejected.Load() != 1 {
+		t.Fatalf("request over the queue got %v, rejected %d", proxyErr, l.rejected.Load())
+	}
+	l.release()
+	if proxyErr := <-got; proxyErr != nil {
+		t.Fatalf("queued request refused after a release: %s", proxyErr)
+	}
+	if l.waits.Load() != 2 {
+		t.Fatalf("waits = %d, want 2", l.waits.Load())
+	}
+}
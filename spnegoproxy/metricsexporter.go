@@ -3,8 +3,19 @@ package spnegoproxy
 import (
 	"io"
 	"net/http"
+	"sync"
 )
 
+var metricsSourcesMu sync.Mutex
+var metricsSources = []func() string{}
+
+// registerMetricsSource adds a producer of metrics lines to the /metrics output
+func registerMetricsSource(source func() string) {
+	metricsSourcesMu.Lock()
+	defer metricsSourcesMu.Unlock()
+	metricsSources = append(metricsSources, source)
+}
+
 func ExposeMetrics(listenAddr string, events WebHDFSEventChannel) {
 	srv := http.NewServeMux()
 	logger.Printf("Configuring handlers for metrics on %s\n", listenAddr)
@@ -21,8 +32,18 @@ func handleRoot(w http.ResponseWriter, r *http.Request) {
 func handleMetrics(w http.ResponseWriter, r *http.Request) {
 	// ctx := r.Context()
 	logger.Print("Requested metrics")
-	io.WriteString(w, webHDFSEvents.String())
+	WriteMetrics(w)
+}
 
+// WriteMetrics writes the current value of every metric to w
+func WriteMetrics(w io.Writer) {
+	io.WriteString(w, webHDFSEvents.String())
+	metricsSourcesMu.Lock()
+	sources := append([]func() string(nil), metricsSources...)
+	metricsSourcesMu.Unlock()
+	for _, source := range sources {
+		io.WriteString(w, source())
+	}
 }
 
 func serveMetrics(addr string, server *http.ServeMux) {
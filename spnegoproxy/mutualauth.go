@@ -0,0 +1,144 @@
+package spnegoproxy
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/matchaxnb/gokrb5/v8/client"
+	"github.com/matchaxnb/gokrb5/v8/crypto"
+	"github.com/matchaxnb/gokrb5/v8/gssapi"
+	"github.com/matchaxnb/gokrb5/v8/iana/flags"
+	"github.com/matchaxnb/gokrb5/v8/iana/keyusage"
+	"github.com/matchaxnb/gokrb5/v8/messages"
+	"github.com/matchaxnb/gokrb5/v8/spnego"
+	"github.com/matchaxnb/gokrb5/v8/types"
+)
+
+// secContext is what we need to remember of the AP-REQ we sent to check the AP-REP the service answers with
+type secContext struct {
+	sessionKey types.EncryptionKey
+	ctime      time.Time
+	cusec      int
+}
+
+// initMutualSecContext builds a SPNEGO token asking the service to authenticate itself back
+func (c *SPNEGOClient) initMutualSecContext() ([]byte, *secContext, error) {
+	if err := c.krbClient.AffirmLogin(); err != nil {
+		return nil, nil, fmt.Errorf("could not acquire client credential: %v", err)
+	}
+	tkt, key, err := c.krbClient.GetServiceTicket(c.spn)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not initialize context: %v", err)
+	}
+	return newKRB5SPNEGOToken(c.krbClient, tkt, key, true)
+}
+
+// newKRB5SPNEGOToken builds a SPNEGO token out of a service ticket for the client of cl. With mutual, the
+// service is asked to authenticate itself back and the context to check its answer is returned.
+func newKRB5SPNEGOToken(cl *client.Client, tkt messages.Ticket, key types.EncryptionKey, mutual bool) ([]byte, *secContext, error) {
+	gssFlags := []int{gssapi.ContextFlagInteg, gssapi.ContextFlagConf}
+	var apOptions []int
+	if mutual {
+		gssFlags = append(gssFlags, gssapi.ContextFlagMutual)
+		apOptions = append(apOptions, flags.APOptionMutualRequired)
+	}
+	mechToken, err := spnego.NewKRB5TokenAPREQ(cl, tkt, key, gssFlags, apOptions)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not initialize context: %v", err)
+	}
+	mechTokenBytes, err := mechToken.Marshal()
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not marshal KRB5 token: %v", err)
+	}
+	token := spnego.SPNEGOToken{
+		Init: true,
+		NegTokenInit: spnego.NegTokenInit{
+			MechTypes:      []asn1.ObjectIdentifier{gssapi.OIDKRB5.OID()},
+			MechTokenBytes: mechTokenBytes,
+		},
+	}
+	b, err := token.Marshal()
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not marshal SPNEGO token: %v", err)
+	}
+	if !mutual {
+		return b, nil, nil
+	}
+	// the authenticator is only kept encrypted, read back the timestamp the AP-REP has to echo
+	if err := mechToken.APReq.DecryptAuthenticator(key); err != nil {
+		return nil, nil, err
+	}
+	return b, &secContext{
+		sessionKey: key,
+		ctime:      mechToken.APReq.Authenticator.CTime,
+		cusec:      mechToken.APReq.Authenticator.Cusec,
+	}, nil
+}
+
+// verifyMutualAuth checks the Negotiate token of a backend response against the context of the request
+func (sc *secContext) verifyMutualAuth(res *http.Response) error {
+	var encoded string
+	for _, v := range res.Header.Values("Www-Authenticate") {
+		if scheme, value, ok := strings.Cut(v, " "); ok && strings.EqualFold(scheme, "Negotiate") {
+			encoded = strings.TrimSpace(value)
+		}
+	}
+	if encoded == "" {
+		return errors.New("no Negotiate token in the response")
+	}
+	b, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("invalid Negotiate token: %v", err)
+	}
+	// the KRB5 token is either wrapped in a NegTokenResp or sent as is
+	if len(b) > 0 && b[0] != 0x60 {
+		var resp spnego.NegTokenResp
+		if err := resp.Unmarshal(b); err != nil {
+			return err
+		}
+		if resp.State() != spnego.NegStateAcceptCompleted {
+			return fmt.Errorf("negotiation not completed (state %d)", resp.State())
+		}
+		b = resp.ResponseToken
+	}
+	var mechToken spnego.KRB5Token
+	if err := mechToken.Unmarshal(b); err != nil {
+		return err
+	}
+	if !mechToken.IsAPRep() {
+		return errors.New("the response token is not an AP-REP")
+	}
+	plain, err := crypto.DecryptEncPart(mechToken.APRep.EncPart, sc.sessionKey, keyusage.AP_REP_ENCPART)
+	if err != nil {
+		return fmt.Errorf("cannot decrypt the AP-REP, the service does not hold the ticket key: %v", err)
+	}
+	var encPart messages.EncAPRepPart
+	if err := encPart.Unmarshal(plain); err != nil {
+		return err
+	}
+	if encPart.CTime.Unix() != sc.ctime.Unix() || encPart.Cusec != sc.cusec {
+		return errors.New("the AP-REP does not match our authenticator")
+	}
+	return nil
+}
+
+func (r *SPNEGOClientRegistry) mutualAuthRequired() bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.mutualAuth
+}
+
+// RequireMutualAuth makes every SPNEGO client of the registry check that the service authenticated itself back
+func (r *SPNEGOClientRegistry) RequireMutualAuth() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.mutualAuth = true
+	for _, e := range r.entries {
+		e.client.mutualAuth = true
+	}
+}
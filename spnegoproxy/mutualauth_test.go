@@ -0,0 +1,99 @@
+package spnegoproxy
+
+import (
+	"encoding/base64"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/matchaxnb/gokrb5/v8/asn1tools"
+	"github.com/matchaxnb/gokrb5/v8/crypto"
+	"github.com/matchaxnb/gokrb5/v8/gssapi"
+	"github.com/matchaxnb/gokrb5/v8/iana/asnAppTag"
+	"github.com/matchaxnb/gokrb5/v8/iana/etypeID"
+	"github.com/matchaxnb/gokrb5/v8/iana/keyusage"
+	"github.com/matchaxnb/gokrb5/v8/iana/msgtype"
+	"github.com/matchaxnb/gokrb5/v8/messages"
+	"github.com/matchaxnb/gokrb5/v8/spnego"
+	"github.com/matchaxnb/gokrb5/v8/types"
+)
+
+func testSessionKey(fill byte) types.EncryptionKey {
+	key := types.EncryptionKey{KeyType: etypeID.AES256_CTS_HMAC_SHA1_96, KeyValue: make([]byte, 32)}
+	for i := range key.KeyValue {
+		key.KeyValue[i] = fill
+	}
+	return key
+}
+
+// newTestAPRep builds the KRB5 AP-REP token a service answers with, gokrb5 only knows how to read them
+func newTestAPRep(t *testing.T, key types.EncryptionKey, ctime time.Time, cusec int) []byte {
+	t.Helper()
+	encPart, err := asn1.Marshal(messages.EncAPRepPart{CTime: ctime, Cusec: cusec})
+	if err != nil {
+		t.Fatal(err)
+	}
+	encrypted, err := crypto.GetEncryptedData(asn1tools.AddASNAppTag(encPart, asnAppTag.EncAPRepPart), key, keyusage.AP_REP_ENCPART, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apRep, err := asn1.Marshal(messages.APRep{PVNO: 5, MsgType: msgtype.KRB_AP_REP, EncPart: encrypted})
+	if err != nil {
+		t.Fatal(err)
+	}
+	oid, _ := asn1.Marshal(gssapi.OIDKRB5.OID())
+	token := append(oid, 0x02, 0x00)
+	token = append(token, asn1tools.AddASNAppTag(apRep, asnAppTag.APREP)...)
+	return asn1tools.AddASNAppTag(token, 0)
+}
+
+// wrapNegTokenResp puts a KRB5 token in the SPNEGO answer most services send
+func wrapNegTokenResp(t *testing.T, state spnego.NegState, krb5Token []byte) []byte {
+	t.Helper()
+	resp := spnego.NegTokenResp{
+		NegState:      asn1.Enumerated(state),
+		SupportedMech: gssapi.OIDKRB5.OID(),
+		ResponseToken: krb5Token,
+	}
+	b, err := resp.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func negotiateResponse(token []byte) *http.Response {
+	header := http.Header{}
+	header.Add("Www-Authenticate", "Negotiate "+base64.StdEncoding.EncodeToString(token))
+	return &http.Response{StatusCode: http.StatusOK, Header: header}
+}
+
+func TestVerifyMutualAuth(t *testing.T) {
+	key := testSessionKey(1)
+	ctime := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	sc := &secContext{sessionKey: key, ctime: ctime, cusec: 1234}
+	tests := []struct {
+		name string
+		res  *http.Response
+		ok   bool
+	}{
+		{"bare AP-REP", negotiateResponse(newTestAPRep(t, key, ctime, 1234)), true},
+		{"AP-REP in a NegTokenResp", negotiateResponse(wrapNegTokenResp(t, spnego.NegStateAcceptCompleted, newTestAPRep(t, key, ctime, 1234))), true},
+		{"negotiation not completed", negotiateResponse(wrapNegTokenResp(t, spnego.NegStateAcceptIncomplete, newTestAPRep(t, key, ctime, 1234))), false},
+		{"negotiation rejected", negotiateResponse(wrapNegTokenResp(t, spnego.NegStateReject, nil)), false},
+		{"no Negotiate header", &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Www-Authenticate": {"Basic realm=hdfs"}}}, false},
+		{"token is not base64", &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Www-Authenticate": {"Negotiate ***"}}}, false},
+		{"token is not a KRB5 token", negotiateResponse([]byte{0x60, 0x03, 0x01, 0x02, 0x03}), false},
+		// the service does not hold the key of the ticket we sent
+		{"AP-REP under another key", negotiateResponse(newTestAPRep(t, testSessionKey(2), ctime, 1234)), false},
+		{"AP-REP of another authenticator", negotiateResponse(newTestAPRep(t, key, ctime.Add(time.Second), 1234)), false},
+		{"AP-REP of another microsecond", negotiateResponse(newTestAPRep(t, key, ctime, 1235)), false},
+	}
+	for _, tt := range tests {
+		err := sc.verifyMutualAuth(tt.res)
+		if ok := err == nil; ok != tt.ok {
+			t.Errorf("%s: verified = %v, want %v (%v)", tt.name, ok, tt.ok, err)
+		}
+	}
+}
@@ -0,0 +1,323 @@
+package spnegoproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// how often the policy file is checked for changes, at most
+const POLICY_RELOAD_CHECK_INTERVAL = time.Second * 10
+
+// prefix of the WebHDFS REST API, policy paths are the HDFS paths that follow it
+const WEBHDFS_PATH_PREFIX = "/webhdfs/v1"
+
+// PolicyRule matches requests on all of its non empty fields
+type PolicyRule struct {
+	Name string `json:"name"`
+	// "allow" or "deny"
+	Effect string `json:"effect"`
+	// HTTP verbs, e.g. GET
+	Methods []string `json:"methods"`
+	// WebHDFS operations, e.g. LISTSTATUS
+	Ops []string `json:"ops"`
+	// HDFS paths, as path.Match patterns, a trailing /** matching the whole subtree
+	Paths []string `json:"paths"`
+	// end user names, * matching any identified user
+	Identities []string `json:"identities"`
+	// client networks in CIDR notation
+	Clients []string `json:"clients"`
+
+	clientNets []*net.IPNet
+}
+
+// PolicyDocument is the content of a policy file, its rules are tried in order and the first match decides
+type PolicyDocument struct {
+	// "allow" or "deny" (the default) for requests no rule matches
+	Default string       `json:"default"`
+	Rules   []PolicyRule `json:"rules"`
+}
+
+// policyRequest is what rules are matched against
+type policyRequest struct {
+	method   string
+	op       string
+	paths    []string
+	identity string
+	ip       net.IP
+}
+
+func parsePolicy(b []byte) (*PolicyDocument, error) {
+	var doc PolicyDocument
+	if err := json.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	if doc.Default == "" {
+		doc.Default = "deny"
+	}
+	if err := checkPolicyEffect(doc.Default); err != nil {
+		return nil, fmt.Errorf("default: %w", err)
+	}
+	for i := range doc.Rules {
+		rule := &doc.Rules[i]
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("#%d", i+1)
+		}
+		if err := checkPolicyEffect(rule.Effect); err != nil {
+			return nil, fmt.Errorf("rule %s: %w", rule.Name, err)
+		}
+		for _, p := range rule.Paths {
+			if _, err := path.Match(strings.TrimSuffix(p, "/**"), "/"); err != nil {
+				return nil, fmt.Errorf("rule %s: bad path pattern %q", rule.Name, p)
+			}
+		}
+		for _, cidr := range rule.Clients {
+			_, ipNet, err := net.ParseCIDR(cidr)
+			if err != nil {
+				return nil, fmt.Errorf("rule %s: %w", rule.Name, err)
+			}
+			rule.clientNets = append(rule.clientNets, ipNet)
+		}
+	}
+	return &doc, nil
+}
+
+func checkPolicyEffect(effect string) error {
+	if effect != "allow" && effect != "deny" {
+		return fmt.Errorf("unknown effect %q (want allow or deny)", effect)
+	}
+	return nil
+}
+
+func (rule *PolicyRule) matches(pr policyRequest, hdfsPath string) bool {
+	if len(rule.Methods) > 0 && !containsFold(rule.Methods, pr.method) {
+		return false
+	}
+	if len(rule.Ops) > 0 && pr.op != "" && !containsFold(rule.Ops, pr.op) {
+		return false
+	}
+	if len(rule.Paths) > 0 && !matchesAnyPath(rule.Paths, hdfsPath) {
+		return false
+	}
+	if len(rule.Identities) > 0 && !(pr.identity != "" && (containsFold(rule.Identities, "*") || containsFold(rule.Identities, pr.identity))) {
+		return false
+	}
+	if len(rule.clientNets) > 0 {
+		found := false
+		for _, ipNet := range rule.clientNets {
+			found = found || (pr.ip != nil && ipNet.Contains(pr.ip))
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func containsFold(list []string, s string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesAnyPath(patterns []string, hdfsPath string) bool {
+	for _, p := range patterns {
+		if subtree, ok := strings.CutSuffix(p, "/**"); ok {
+			if subtree == "" || hdfsPath == subtree || strings.HasPrefix(hdfsPath, subtree+"/") {
+				return true
+			}
+			// the subtree root may be a pattern as well, as in /user/*/**
+			for dir := hdfsPath; dir != "/" && dir != "."; dir = path.Dir(dir) {
+				if ok, _ := path.Match(subtree, dir); ok {
+					return true
+				}
+			}
+			continue
+		}
+		if ok, _ := path.Match(p, hdfsPath); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// decide returns the rule deciding pr, nil when the default applies, and whether pr is allowed.
+// A request naming several paths, as RENAME and CONCAT do, is allowed only when each of them is.
+func (doc *PolicyDocument) decide(pr policyRequest) (rule *PolicyRule, allowed bool) {
+	for _, p := range pr.paths {
+		if rule, allowed = doc.decidePath(pr, p); !allowed {
+			break
+		}
+	}
+	return rule, allowed
+}
+
+func (doc *PolicyDocument) decidePath(pr policyRequest, hdfsPath string) (*PolicyRule, bool) {
+	for i := range doc.Rules {
+		rule := &doc.Rules[i]
+		if rule.matches(pr, hdfsPath) {
+			// a request whose operation is unknown to us could be any of those the rule is about
+			if len(rule.Ops) > 0 && pr.op == "" {
+				return rule, false
+			}
+			return rule, rule.Effect == "allow"
+		}
+	}
+	return nil, doc.Default == "allow"
+}
+
+// hdfsPathOf gives the HDFS path a proxy request targets, through a DataNode route or not
+func hdfsPathOf(urlPath string) string {
+	if _, rest, ok := splitDataNodeRoute(urlPath); ok {
+		urlPath = rest
+	}
+	p := strings.TrimPrefix(urlPath, WEBHDFS_PATH_PREFIX)
+	return path.Clean("/" + p)
+}
+
+func newPolicyRequest(r *http.Request) policyRequest {
+	event, _ := ClassifyWebHDFSRequest(r)
+	pr := policyRequest{
+		method:   r.Method,
+		op:       string(event.Op()),
+		paths:    []string{hdfsPathOf(r.URL.Path)},
+		identity: RequestIdentity(r),
+	}
+	// an ambiguous query has no op, which no rule about operations allows
+	q, _ := webHDFSQuery(r.URL)
+	if dest := q.Get("destination"); dest != "" {
+		pr.paths = append(pr.paths, path.Clean("/"+dest))
+	}
+	// CONCAT empties its sources into the target
+	if sources := q.Get("sources"); sources != "" {
+		for _, source := range strings.Split(sources, ",") {
+			pr.paths = append(pr.paths, path.Clean("/"+source))
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	pr.ip = net.ParseIP(host)
+	return pr
+}
+
+// PolicyEngine allows or denies requests according to a policy file, which it reloads when it changes
+type PolicyEngine struct {
+	file      string
+	debug     bool
+	mu        sync.Mutex
+	doc       *PolicyDocument
+	modTime   time.Time
+	lastCheck time.Time
+	allowed   atomic.Uint64
+	denied    atomic.Uint64
+	reloads   atomic.Uint64
+	failures  atomic.Uint64
+}
+
+func NewPolicyEngine(policyFile string, debug bool) (*PolicyEngine, error) {
+	e := &PolicyEngine{file: policyFile, debug: debug}
+	if err := e.load(); err != nil {
+		return nil, err
+	}
+	registerMetricsSource(e.metrics)
+	return e, nil
+}
+
+// EnablePolicy loads policyFile and makes every request go through it before reaching a backend
+func EnablePolicy(policyFile string, debug bool) error {
+	e, err := NewPolicyEngine(policyFile, debug)
+	if err != nil {
+		return err
+	}
+	RegisterRequestAdmissionCallback(e.Admit)
+	return nil
+}
+
+func (e *PolicyEngine) load() error {
+	st, err := os.Stat(e.file)
+	if err != nil {
+		return fmt.Errorf("cannot stat policy file: %w", err)
+	}
+	b, err := os.ReadFile(e.file)
+	if err != nil {
+		return fmt.Errorf("cannot read policy file: %w", err)
+	}
+	doc, err := parsePolicy(b)
+	if err != nil {
+		return fmt.Errorf("invalid policy file %s: %w", e.file, err)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.doc, e.modTime, e.lastCheck = doc, st.ModTime(), time.Now()
+	logger.Printf("Loaded policy %s with %d rules, default %s", e.file, len(doc.Rules), doc.Default)
+	return nil
+}
+
+// current returns the policy in force, loading the file again when it changed
+func (e *PolicyEngine) current() *PolicyDocument {
+	e.mu.Lock()
+	check := time.Since(e.lastCheck) > POLICY_RELOAD_CHECK_INTERVAL
+	if check {
+		e.lastCheck = time.Now()
+	}
+	doc, modTime := e.doc, e.modTime
+	e.mu.Unlock()
+	if check {
+		if st, err := os.Stat(e.file); err == nil && !st.ModTime().Equal(modTime) {
+			// a broken edit must not open or close everything, keep the policy we have
+			if err := e.load(); err != nil {
+				e.failures.Add(1)
+				logger.Printf("Keeping the current policy: %s", err)
+			} else {
+				e.reloads.Add(1)
+				e.mu.Lock()
+				doc = e.doc
+				e.mu.Unlock()
+			}
+		}
+	}
+	return doc
+}
+
+// Admit is the RequestAdmissionCallback of the policy
+func (e *PolicyEngine) Admit(r *http.Request) *ProxyError {
+	pr := newPolicyRequest(r)
+	rule, allowed := e.current().decide(pr)
+	ruleName := "default"
+	if rule != nil {
+		ruleName = rule.Name
+	}
+	if allowed {
+		e.allowed.Add(1)
+		if e.debug {
+			logger.Printf("policy rule %s allows %s %s for %q", ruleName, pr.op, pr.paths, pr.identity)
+		}
+		return nil
+	}
+	e.denied.Add(1)
+	return NewProxyError(http.StatusForbidden, "AccessControlException", "org.apache.hadoop.security.AccessControlException",
+		fmt.Sprintf("Permission denied by proxy policy (rule %s): %s %s", ruleName, r.Method, strings.Join(pr.paths, " -> ")))
+}
+
+func (e *PolicyEngine) metrics() string {
+	e.mu.Lock()
+	rules := len(e.doc.Rules)
+	e.mu.Unlock()
+	return fmt.Sprintf("policy_rules %d\n", rules) +
+		fmt.Sprintf("policy_decisions_total{effect=\"allow\"} %d\n", e.allowed.Load()) +
+		fmt.Sprintf("policy_decisions_total{effect=\"deny\"} %d\n", e.denied.Load()) +
+		fmt.Sprintf("policy_reloads_total %d\n", e.reloads.Load()) +
+		fmt.Sprintf("policy_reload_failures_total %d\n", e.failures.Load())
+}
@@ -0,0 +1,120 @@
+package spnegoproxy
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+const testPolicy = `{
+	"default": "deny",
+	"rules": [
+		{"name": "no-tmp-writes", "effect": "deny", "methods": ["PUT", "POST", "DELETE"], "paths": ["/tmp/**"]},
+		{"name": "tmp", "effect": "allow", "paths": ["/tmp/**"]},
+		{"name": "homes", "effect": "allow", "paths": ["/user/*/**"], "identities": ["*"]},
+		{"name": "reads", "effect": "allow", "methods": ["GET"], "ops": ["liststatus", "GETFILESTATUS", "Open"], "paths": ["/data/**"]},
+		{"name": "etl", "effect": "allow", "ops": ["MKDIRS", "RENAME"], "paths": ["/data/*"], "identities": ["etl"], "clients": ["10.0.0.0/8"]}
+	]
+}`
+
+func newTestPolicyRequest(method, target, identity, remoteAddr string) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	r.RemoteAddr = remoteAddr
+	return r.WithContext(context.WithValue(r.Context(), identityContextKey, identity))
+}
+
+func TestPolicyDecide(t *testing.T) {
+	doc, err := parsePolicy([]byte(testPolicy))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		method   string
+		target   string
+		identity string
+		client   string
+		rule     string
+		allowed  bool
+	}{
+		{http.MethodGet, "/webhdfs/v1/tmp?op=LISTSTATUS", "", "192.0.2.1:1234", "tmp", true},
+		{http.MethodGet, "/webhdfs/v1/tmp/a/b?op=OPEN", "", "192.0.2.1:1234", "tmp", true},
+		{http.MethodPut, "/webhdfs/v1/tmp/a?op=MKDIRS", "", "192.0.2.1:1234", "no-tmp-writes", false},
+		// only the subtree, not its siblings
+		{http.MethodGet, "/webhdfs/v1/tmpfiles?op=LISTSTATUS", "", "192.0.2.1:1234", "", false},
+		{http.MethodPut, "/webhdfs/v1/user/alice/x?op=CREATE", "alice", "192.0.2.1:1234", "homes", true},
+		{http.MethodPut, "/webhdfs/v1/user/alice/x?op=CREATE", "", "192.0.2.1:1234", "", false},
+		{http.MethodGet, "/webhdfs/v1/data/a?op=LISTSTATUS", "", "192.0.2.1:1234", "reads", true},
+		{http.MethodGet, "/webhdfs/v1/data/a?op=liststatus", "", "192.0.2.1:1234", "reads", true},
+		{http.MethodGet, "/webhdfs/v1/data/a?OP=GetFileStatus", "", "192.0.2.1:1234", "reads", true},
+		{http.MethodGet, "/webhdfs/v1/data/a/b?op=OPEN", "", "192.0.2.1:1234", "reads", true},
+		{http.MethodGet, "/webhdfs/v1/data/a?op=GETCONTENTSUMMARY", "", "192.0.2.1:1234", "", false},
+		{http.MethodGet, "/webhdfs/v1/data/a?op=NOSUCHOP", "", "192.0.2.1:1234", "", false},
+		// a missing or ambiguous op could be any of those of a rule about ops, which denies it
+		{http.MethodGet, "/webhdfs/v1/data/a", "", "192.0.2.1:1234", "reads", false},
+		{http.MethodGet, "/webhdfs/v1/data/a?op=OPEN&op=DELETE", "", "192.0.2.1:1234", "reads", false},
+		{http.MethodPut, "/webhdfs/v1/data/a?op=MKDIRS", "etl", "10.1.2.3:1234", "etl", true},
+		{http.MethodPut, "/webhdfs/v1/data/a?op=MKDIRS", "etl", "192.0.2.1:1234", "", false},
+		{http.MethodPut, "/webhdfs/v1/data/a?op=MKDIRS", "bob", "10.1.2.3:1234", "", false},
+		{http.MethodPut, "/webhdfs/v1/data/a/b?op=MKDIRS", "etl", "10.1.2.3:1234", "", false},
+		// both ends of a rename must be allowed
+		{http.MethodPut, "/webhdfs/v1/data/a?op=RENAME&destination=/data/b", "etl", "10.1.2.3:1234", "etl", true},
+		{http.MethodPut, "/webhdfs/v1/data/a?op=RENAME&destination=/secret/b", "etl", "10.1.2.3:1234", "", false},
+		{http.MethodPut, "/webhdfs/v1/data/a?op=RENAME&Destination=/secret/b", "etl", "10.1.2.3:1234", "", false},
+		{http.MethodPut, "/webhdfs/v1/data/a?op=RENAME&destination=/data/../secret", "etl", "10.1.2.3:1234", "", false},
+		// and each source of a concat
+		{http.MethodPost, "/webhdfs/v1/tmp/a?op=CONCAT&sources=/tmp/b,/tmp/c", "", "192.0.2.1:1234", "no-tmp-writes", false},
+		{http.MethodPost, "/webhdfs/v1/user/alice/a?op=CONCAT&sources=/user/alice/b", "alice", "192.0.2.1:1234", "homes", true},
+		{http.MethodPost, "/webhdfs/v1/user/alice/a?op=CONCAT&sources=/user/alice/b,/secret/c", "alice", "192.0.2.1:1234", "", false},
+		{http.MethodPost, "/webhdfs/v1/user/alice/a?op=CONCAT&Sources=/secret/c", "alice", "192.0.2.1:1234", "", false},
+		{http.MethodPost, "/webhdfs/v1/user/alice/a?op=CONCAT&sources=/user/alice/../../secret/c", "alice", "192.0.2.1:1234", "", false},
+		{http.MethodGet, "/webhdfs/v1/secret?op=LISTSTATUS", "alice", "10.1.2.3:1234", "", false},
+	}
+	for _, tt := range tests {
+		rule, allowed := doc.decide(newPolicyRequest(newTestPolicyRequest(tt.method, tt.target, tt.identity, tt.client)))
+		ruleName := ""
+		if rule != nil {
+			ruleName = rule.Name
+		}
+		if ruleName != tt.rule || allowed != tt.allowed {
+			t.Errorf("%s %s as %q from %s: rule %q allowed = %v, want rule %q allowed = %v",
+				tt.method, tt.target, tt.identity, tt.client, ruleName, allowed, tt.rule, tt.allowed)
+		}
+	}
+}
+
+func TestPolicyDefault(t *testing.T) {
+	tests := []struct {
+		policy  string
+		allowed bool
+	}{
+		{`{"rules": []}`, false},
+		{`{"default": "deny"}`, false},
+		{`{"default": "allow"}`, true},
+	}
+	for _, tt := range tests {
+		doc, err := parsePolicy([]byte(tt.policy))
+		if err != nil {
+			t.Fatalf("%s: %s", tt.policy, err)
+		}
+		rule, allowed := doc.decide(newPolicyRequest(newTestPolicyRequest(http.MethodGet, "/webhdfs/v1/a?op=OPEN", "", "192.0.2.1:1234")))
+		if rule != nil || allowed != tt.allowed {
+			t.Errorf("%s: rule %v allowed = %v, want the default and %v", tt.policy, rule, allowed, tt.allowed)
+		}
+	}
+}
+
+func TestParsePolicyErrors(t *testing.T) {
+	tests := []string{
+		`not json`,
+		`{"default": "maybe"}`,
+		`{"rules": [{"effect": "permit"}]}`,
+		`{"rules": [{"effect": "allow", "paths": ["/data/[a"]}]}`,
+		`{"rules": [{"effect": "allow", "clients": ["10.0.0.0"]}]}`,
+	}
+	for _, policy := range tests {
+		if _, err := parsePolicy([]byte(policy)); err == nil {
+			t.Errorf("%s: parsed without error", policy)
+		}
+	}
+}
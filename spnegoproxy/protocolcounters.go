@@ -1,9 +1,10 @@
 package spnegoproxy
 
 import (
-	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
 )
 
 type WebHDFSOp string
@@ -14,6 +15,7 @@ const (
 	WebHDFSPost
 	WebHDFSPut
 	WebHDFSDelete
+	WebHDFSOther
 )
 
 type WebHDFSEvent struct {
@@ -57,114 +59,131 @@ var (
 
 type WebHDFSEventChannel chan WebHDFSEvent
 
-// process a request
-func ProcessWebHDFSRequestQuery(req *http.Request, eventStream WebHDFSEventChannel) error {
+var webHDFSVerbs = map[string]WebHDFSVerb{
+	http.MethodGet:    WebHDFSGet,
+	http.MethodPost:   WebHDFSPost,
+	http.MethodPut:    WebHDFSPut,
+	http.MethodDelete: WebHDFSDelete,
+}
+
+var knownWebHDFSEvents = map[WebHDFSEvent]bool{
+	WebHDFSGetOpen:                  true,
+	WebHDFSGetGetFileStatus:         true,
+	WebHDFSGetListStatus:            true,
+	WebHDFSGetGetContentSummary:     true,
+	WebHDFSGetGetFileChecksum:       true,
+	WebHDFSGetGetHomeDirectory:      true,
+	WebHDFSGetGetDelegationToken:    true,
+	WebHDFSPutCreate:                true,
+	WebHDFSPutMkdirs:                true,
+	WebHDFSPutRename:                true,
+	WebHDFSPutSetReplication:        true,
+	WebHDFSPutSetOwner:              true,
+	WebHDFSPutSetPermission:         true,
+	WebHDFSPutSetTimes:              true,
+	WebHDFSPutRenewDelegationToken:  true,
+	WebHDFSPutCancelDelegationToken: true,
+	WebHDFSPostAppend:               true,
+	WebHDFSDeleteDelete:             true,
+}
+
+func (e WebHDFSEvent) Verb() WebHDFSVerb {
+	return e.verb
+}
+
+func (e WebHDFSEvent) Op() WebHDFSOp {
+	return e.op
+}
+
+// WebHDFSOpClass groups operations by what they cost the cluster
+type WebHDFSOpClass string
+
+const (
+	// reads answered by the NameNode alone
+	WebHDFSMetadataClass WebHDFSOpClass = "metadata"
+	// operations moving file contents through DataNodes
+	WebHDFSDataClass WebHDFSOpClass = "data"
+	// every other change to the namespace, and unknown operations
+	WebHDFSMutatingClass WebHDFSOpClass = "mutating"
+)
+
+var webHDFSOpClasses = []WebHDFSOpClass{WebHDFSMetadataClass, WebHDFSDataClass, WebHDFSMutatingClass}
 
-	switch verb := req.Method; verb {
-	case http.MethodGet:
-		return processWebHDFSGetRequest(req, eventStream)
-	case http.MethodPost:
-		return processWebHDFSPostRequest(req, eventStream)
-	case http.MethodPut:
-		return processWebHDFSPutRequest(req, eventStream)
-	case http.MethodDelete:
-		return processWebHDFSDeleteRequest(req, eventStream)
+// Class tells the class of the operation, unknown GET operations being taken for metadata reads
+func (e WebHDFSEvent) Class() WebHDFSOpClass {
+	switch {
+	case redirectedWebHDFSEvents[e]:
+		return WebHDFSDataClass
+	case e.verb == WebHDFSGet:
+		return WebHDFSMetadataClass
 	default:
-		err := fmt.Errorf("unhandled WebHDFS HTTP verb %s", verb)
-		return err
+		return WebHDFSMutatingClass
 	}
 }
 
-// processWebHDFSGetRequest processes GET requests for WebHDFS
-func processWebHDFSGetRequest(req *http.Request, eventStream WebHDFSEventChannel) error {
-	q := req.URL.Query()
-	op := q.Get("op")
-	switch op {
-	case "":
-		eventStream <- WebHDFSWrongGet
-		return errors.New("GET with no op=")
-	case "OPEN":
-		eventStream <- WebHDFSGetOpen
-	case "GETFILESTATUS":
-		eventStream <- WebHDFSGetGetFileStatus
-	case "LISTSTATUS":
-		eventStream <- WebHDFSGetListStatus
-	case "GETCONTENTSUMMARY":
-		eventStream <- WebHDFSGetGetContentSummary
-	case "GETFILECHECKSUM":
-		eventStream <- WebHDFSGetGetFileChecksum
-	case "GETHOMEDIRECTORY":
-		eventStream <- WebHDFSGetGetHomeDirectory
-	case "GETDELEGATIONTOKEN":
-		eventStream <- WebHDFSGetGetDelegationToken
-	default:
-		return fmt.Errorf("processWebHDFSGetRequest unhandled operation: %s", op)
+func (v WebHDFSVerb) String() string {
+	for method, verb := range webHDFSVerbs {
+		if verb == v {
+			return method
+		}
 	}
-	return nil
+	return "UNKNOWN"
 }
 
-// processWebHDFSPostRequest processes POST requests for WebHDFS
-func processWebHDFSPostRequest(req *http.Request, eventStream WebHDFSEventChannel) error {
-	q := req.URL.Query()
-	op := q.Get("op")
-	switch op {
-	case "":
-		eventStream <- WebHDFSWrongPost
-		return errors.New("POST with no op=")
-	case "APPEND":
-		eventStream <- WebHDFSPostAppend
-	default:
-		return fmt.Errorf("processWebHDFSPostRequest unhandled operation: %s", op)
+// WebHDFS parameters a request may carry only once, whatever their case
+var singleWebHDFSParams = []string{"op", "destination", "sources", "doas", "user.name", "delegation"}
+
+// webHDFSQuery returns the query of u with its parameter names lowercased, the way Hadoop reads them.
+// A query that does not parse, or gives a single valued parameter more than once, is an error.
+func webHDFSQuery(u *url.URL) (url.Values, error) {
+	raw, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, fmt.Errorf("invalid query: %w", err)
 	}
-	return nil
+	q := make(url.Values, len(raw))
+	for k, values := range raw {
+		lower := strings.ToLower(k)
+		q[lower] = append(q[lower], values...)
+	}
+	for _, k := range singleWebHDFSParams {
+		if len(q[k]) > 1 {
+			return nil, fmt.Errorf("parameter %s is given %d times", k, len(q[k]))
+		}
+	}
+	return q, nil
 }
 
-// processWebHDFSPutRequest processes PUT requests for WebHDFS
-func processWebHDFSPutRequest(req *http.Request, eventStream WebHDFSEventChannel) error {
-	q := req.URL.Query()
+// ClassifyWebHDFSRequest finds the WebHDFS event matching a request, without recording it.
+// Parameter names are case insensitive. A request with no op=, or an ambiguous query, gives one of
+// the WebHDFSWrong* events along with an error,
+// an unknown op gives an event with that op along with an error.
+func ClassifyWebHDFSRequest(req *http.Request) (WebHDFSEvent, error) {
+	verb, ok := webHDFSVerbs[req.Method]
+	if !ok {
+		return WebHDFSEvent{WebHDFSOther, ""}, fmt.Errorf("unhandled WebHDFS HTTP verb %s", req.Method)
+	}
+	q, err := webHDFSQuery(req.URL)
+	if err != nil {
+		return WebHDFSEvent{verb, ""}, err
+	}
 	op := q.Get("op")
-	switch op {
-	case "":
-		eventStream <- WebHDFSWrongPut
-		return errors.New("PUT with no op=")
-	case "CREATE":
-		eventStream <- WebHDFSPutCreate
-	case "MKDIRS":
-		eventStream <- WebHDFSPutMkdirs
-	case "RENAME":
-		eventStream <- WebHDFSPutRename
-	case "SETREPLICATION":
-		eventStream <- WebHDFSPutSetReplication
-	case "SETOWNER":
-		eventStream <- WebHDFSPutSetOwner
-	case "SETPERMISSION":
-		eventStream <- WebHDFSPutSetPermission
-	case "SETTIMES":
-		eventStream <- WebHDFSPutSetTimes
-	case "RENEWDELEGATIONTOKEN":
-		eventStream <- WebHDFSPutRenewDelegationToken
-	case "CANCELDELEGATIONTOKEN":
-		eventStream <- WebHDFSPutCancelDelegationToken
-	default:
-		return fmt.Errorf("processWebHDFSPutRequest unhandled operation: %s", op)
+	event := WebHDFSEvent{verb, WebHDFSOp(strings.ToUpper(op))}
+	if op == "" {
+		return event, fmt.Errorf("%s with no op=", req.Method)
 	}
-	return nil
+	if !knownWebHDFSEvents[event] {
+		return event, fmt.Errorf("unhandled WebHDFS %s operation: %s", req.Method, op)
+	}
+	return event, nil
 }
 
-// processWebHDFSDeleteRequest processes DELETE requests for WebHDFS
-func processWebHDFSDeleteRequest(req *http.Request, eventStream WebHDFSEventChannel) error {
-	q := req.URL.Query()
-	op := q.Get("op")
-	switch op {
-	case "":
-		eventStream <- WebHDFSWrongDelete
-		return errors.New("DELETE with no op=")
-	case "DELETE":
-		eventStream <- WebHDFSDeleteDelete
-	default:
-		return fmt.Errorf("processWebHDFSDeleteRequest unhandled operation: %s", op)
+// process a request
+func ProcessWebHDFSRequestQuery(req *http.Request, eventStream WebHDFSEventChannel) error {
+	event, err := ClassifyWebHDFSRequest(req)
+	if err == nil || (event.op == "" && event.verb != WebHDFSOther) {
+		eventStream <- event
 	}
-	return nil
+	return err
 }
 
 func ConsumeWebHDFSEventStream(stream WebHDFSEventChannel) {
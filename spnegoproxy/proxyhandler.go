@@ -0,0 +1,334 @@
+package spnegoproxy
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// upstream connection pool settings
+const UPSTREAM_MAX_IDLE_CONNS_PER_HOST = 32
+const UPSTREAM_IDLE_CONN_TIMEOUT = time.Second * 90
+
+// client side server settings
+const CLIENT_READ_HEADER_TIMEOUT = time.Second * 30
+const CLIENT_IDLE_TIMEOUT = time.Second * 120
+
+type contextKey int
+
+const (
+	backendContextKey contextKey = iota
+	clientURLContextKey
+	identityContextKey
+	requestResultContextKey
+)
+
+func backendFromContext(ctx context.Context) *Backend {
+	backend, _ := ctx.Value(backendContextKey).(*Backend)
+	return backend
+}
+
+// clientURLFromContext gives the scheme and host the client used to reach the proxy
+func clientURLFromContext(ctx context.Context) *url.URL {
+	clientURL, _ := ctx.Value(clientURLContextKey).(*url.URL)
+	return clientURL
+}
+
+// ProxyHandler forwards every client request to a backend of the pool, adding SPNEGO authentication
+type ProxyHandler struct {
+	pool             *BackendPool
+	proxy            *httputil.ReverseProxy
+	upstream         *http.Transport
+	upstreamScheme   string
+	debug            bool
+	redirectMode     RedirectMode
+	redirects        redirectStats
+	dataNodes        dataNodeRoutes
+	authCookies      authCookieJar
+	identity         *IdentityResolver
+	impersonation    ImpersonationMode
+	delegationTokens *delegationTokenManager
+	chroot           string
+	chrootEscapes    atomic.Uint64
+	inFlight         *concurrencyLimiter
+}
+
+func NewProxyHandler(pool *BackendPool, debug bool) *ProxyHandler {
+	h := &ProxyHandler{
+		pool:           pool,
+		upstream:       newUpstreamTransport(),
+		upstreamScheme: "http",
+		debug:          debug,
+		redirectMode:   RedirectPassthrough,
+		impersonation:  ImpersonateNone,
+	}
+	if pool.registry != nil {
+		registerMetricsSource(h.authCookies.metrics)
+	}
+	var transport http.RoundTripper = h.upstream
+	transport = &spnegoTransport{next: transport, handler: h}
+	transport = &redirectTransport{next: transport, handler: h}
+	h.proxy = &httputil.ReverseProxy{
+		Rewrite:        h.rewrite,
+		Transport:      transport,
+		ModifyResponse: h.modifyResponse,
+		ErrorHandler:   h.handleError,
+		ErrorLog:       log.New(logger.Writer(), logger.Prefix(), logger.Flags()),
+	}
+	return h
+}
+
+// NewProxyServer builds the HTTP server clients talk to
+func NewProxyServer(handler http.Handler) *http.Server {
+	return &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: CLIENT_READ_HEADER_TIMEOUT,
+		IdleTimeout:       CLIENT_IDLE_TIMEOUT,
+		ErrorLog:          log.New(logger.Writer(), logger.Prefix(), logger.Flags()),
+	}
+}
+
+func newUpstreamTransport() *http.Transport {
+	return &http.Transport{
+		DialContext: (&net.Dialer{
+			Timeout:   UPSTREAM_DIAL_TIMEOUT,
+			KeepAlive: 30 * time.Second,
+		}).DialContext,
+		MaxIdleConnsPerHost:   UPSTREAM_MAX_IDLE_CONNS_PER_HOST,
+		IdleConnTimeout:       UPSTREAM_IDLE_CONN_TIMEOUT,
+		ExpectContinueTimeout: 1 * time.Second,
+	}
+}
+
+func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	defer recoverPanic(fmt.Sprintf("handling request from %s", r.RemoteAddr))
+	if h.debug {
+		logger.Printf("new request from %s: %s %s", r.RemoteAddr, r.Method, r.URL)
+	}
+	var identity string
+	if h.identity != nil {
+		identity = h.identity.Resolve(r)
+		if identity == "" && h.impersonation != ImpersonateNone {
+			logger.Printf("Refusing request from %s without an end user identity", r.RemoteAddr)
+			NewProxyError(http.StatusUnauthorized, "AuthenticationException",
+				"org.apache.hadoop.security.authentication.client.AuthenticationException",
+				"no end user identity in the request").writeResponse(w)
+			return
+		}
+	}
+	r = r.WithContext(context.WithValue(r.Context(), identityContextKey, identity))
+	if h.chroot != "" {
+		if proxyErr := h.checkChroot(r); proxyErr != nil {
+			logger.Printf("Refusing %s %s for client %s: %s", r.Method, r.URL.Path, r.RemoteAddr, proxyErr)
+			proxyErr.writeResponse(w)
+			return
+		}
+	}
+	if proxyErr := handleAdmissionCallbacks(r); proxyErr != nil {
+		logger.Printf("Refusing %s %s for client %s: %s", r.Method, r.URL.Path, r.RemoteAddr, proxyErr)
+		proxyErr.writeResponse(w)
+		return
+	}
+	if h.inFlight != nil {
+		if proxyErr := h.inFlight.acquire(r.Context()); proxyErr != nil {
+			logger.Printf("Refusing %s %s for client %s: %s", r.Method, r.URL.Path, r.RemoteAddr, proxyErr)
+			proxyErr.writeResponse(w)
+			return
+		}
+		defer h.inFlight.release()
+	}
+	var backend *Backend
+	if strings.HasPrefix(r.URL.Path, DATANODE_ROUTE_PREFIX) {
+		var proxyErr *ProxyError
+		if backend, proxyErr = h.dataNodeBackend(r); proxyErr != nil {
+			logger.Printf("Refusing DataNode route %s for client %s: %s", r.URL.Path, r.RemoteAddr, proxyErr)
+			proxyErr.writeResponse(w)
+			return
+		}
+	} else {
+		var err error
+		if backend, err = h.pool.Pick(r.RemoteAddr); err != nil {
+			logger.Printf("Cannot pick a backend for client %s: %s", r.RemoteAddr, err)
+			NewProxyError(http.StatusServiceUnavailable, "IOException", "java.io.IOException", err.Error()).writeResponse(w)
+			return
+		}
+	}
+	ticket, allowed := backend.breaker.allow()
+	if !allowed {
+		logger.Printf("Circuit of backend %s is open, refusing client %s", backend.Address(), r.RemoteAddr)
+		NewProxyError(http.StatusServiceUnavailable, "IOException", "java.io.IOException",
+			fmt.Sprintf("backend %s is failing, try again later", backend.Address())).writeResponse(w)
+		return
+	}
+	result := &requestResult{}
+	defer backend.breaker.done(ticket, result)
+	backend.Acquire()
+	defer backend.Release()
+	if h.debug {
+		logger.Printf("client %s goes to backend %s", r.RemoteAddr, backend.Address())
+	}
+	clientURL := &url.URL{Scheme: "http", Host: r.Host}
+	if r.TLS != nil {
+		clientURL.Scheme = "https"
+	}
+	ctx := context.WithValue(r.Context(), backendContextKey, backend)
+	ctx = context.WithValue(ctx, clientURLContextKey, clientURL)
+	ctx = context.WithValue(ctx, requestResultContextKey, result)
+	h.proxy.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// rewrite turns the client request into the backend request
+func (h *ProxyHandler) rewrite(pr *httputil.ProxyRequest) {
+	backend := backendFromContext(pr.In.Context())
+	pr.Out.URL.Scheme = h.upstreamScheme
+	pr.Out.URL.Host = backend.Address()
+	if backend.dataNode {
+		var hostport string
+		hostport, pr.Out.URL.Path, _ = splitDataNodeRoute(pr.Out.URL.Path)
+		pr.Out.URL.RawPath = ""
+		h.restoreDataNodeToken(pr.Out, hostport)
+	}
+	pr.Out.Host = backend.Address()
+	if h.chroot != "" {
+		h.jailRequest(pr.Out)
+	}
+	pr.Out.Header.Set("User-agent", "hadoop-proxy/0.1")
+	if h.pool.registry != nil {
+		dropAuthCookie(pr.Out)
+	}
+	if h.identity != nil {
+		h.identity.scrub(pr.Out)
+		h.impersonate(pr.Out, identityFromContext(pr.In.Context()))
+	}
+	handleRequestCallbacks(pr.Out) // needs to be synchronous
+}
+
+func (h *ProxyHandler) modifyResponse(res *http.Response) error {
+	res.Header.Del("Www-Authenticate")
+	res.Header.Del("Set-Cookie")
+	if result := requestResultFromContext(res.Request.Context()); result != nil {
+		result.failed = backendFailed(res)
+	}
+	if h.redirectMode == RedirectRewrite {
+		if err := h.rewriteRedirect(res); err != nil {
+			return err
+		}
+	}
+	if h.chroot != "" {
+		return h.unjailResponse(res)
+	}
+	return nil
+}
+
+func (h *ProxyHandler) handleError(w http.ResponseWriter, r *http.Request, err error) {
+	result := requestResultFromContext(r.Context())
+	if errors.Is(err, context.Canceled) {
+		// the client went away, nobody is listening for an answer
+		if result != nil {
+			result.canceled = true
+		}
+		if h.debug {
+			logger.Printf("client %s canceled %s %s", r.RemoteAddr, r.Method, r.URL)
+		}
+		return
+	}
+	if result != nil {
+		result.failed = true
+	}
+	var proxyErr *ProxyError
+	if !errors.As(err, &proxyErr) {
+		proxyErr = upstreamError(backendFromContext(r.Context()).Address(), err)
+	}
+	logger.Printf("failed to proxy %s %s for %s: %s", r.Method, r.URL, r.RemoteAddr, err)
+	proxyErr.writeResponse(w)
+}
+
+// spnegoClientFor returns the SPNEGO client of the host a request goes to, nil when no Kerberos auth happens
+func (h *ProxyHandler) spnegoClientFor(req *http.Request) *SPNEGOClient {
+	if h.pool.registry == nil {
+		return nil
+	}
+	return h.pool.registry.ForHost(req.URL.Hostname())
+}
+
+// spnegoTransport sets the Authorization header for the host the request goes to,
+// which is a backend of the pool or a DataNode it redirected us to
+type spnegoTransport struct {
+	next    http.RoundTripper
+	handler *ProxyHandler
+	// set on the transport getting the delegation tokens themselves
+	noDelegation bool
+	// set on the transport of health checks, which must see Kerberos failing
+	noCookie bool
+}
+
+func (t *spnegoTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	spnegoCli := t.handler.spnegoClientFor(req)
+	if spnegoCli == nil {
+		if t.handler.debug {
+			logger.Print("no SPNEGO client is set, so no Kerberos auth happening (this is fine)")
+		}
+		return t.next.RoundTrip(req)
+	}
+	// the cookie authenticates whoever the token was made for
+	cookieKey := req.URL.Host
+	user := identityFromContext(req.Context())
+	delegated := spnegoCli.delegator != nil && user != ""
+	if delegated {
+		cookieKey = user + "@" + req.URL.Host
+	}
+	// only a fresh SPNEGO exchange gets the backend to prove its identity
+	reuse := !t.noCookie && !spnegoCli.mutualAuth
+	if t.handler.delegationTokens != nil && !t.noDelegation && reuse && !delegated {
+		if res, err := t.roundTripWithDelegationToken(req); res != nil || err != nil {
+			return res, err
+		}
+	}
+	if reuse {
+		if res, err := t.roundTripWithCookie(req, cookieKey); res != nil || err != nil {
+			return res, err
+		}
+	}
+	var token string
+	var sc *secContext
+	var err error
+	if delegated {
+		token, sc, err = spnegoCli.getDelegatedToken(user)
+	} else {
+		token, sc, err = spnegoCli.getTokenWithContext()
+	}
+	if err != nil {
+		logger.Printf("failed to get SPNEGO token: %v", err)
+		return nil, NewProxyError(http.StatusBadGateway, "AuthenticationException",
+			"org.apache.hadoop.security.authentication.client.AuthenticationException",
+			fmt.Sprintf("cannot get a SPNEGO token for %s: %s", spnegoCli.SPN(), err))
+	}
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Negotiate "+token)
+	res, err := t.next.RoundTrip(req)
+	if err != nil || res.StatusCode == http.StatusUnauthorized {
+		return res, err
+	}
+	if sc == nil {
+		t.handler.authCookies.store(cookieKey, res)
+		return res, nil
+	}
+	if err := sc.verifyMutualAuth(res); err != nil {
+		spnegoCli.mutualFailed.Add(1)
+		res.Body.Close()
+		logger.Printf("mutual authentication with %s failed: %s", spnegoCli.SPN(), err)
+		return nil, NewProxyError(http.StatusBadGateway, "AuthenticationException",
+			"org.apache.hadoop.security.authentication.client.AuthenticationException",
+			fmt.Sprintf("mutual authentication with %s failed: %s", spnegoCli.SPN(), err))
+	}
+	spnegoCli.mutualOK.Add(1)
+	return res, nil
+}
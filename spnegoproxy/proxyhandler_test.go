@@ -0,0 +1,282 @@
+package spnegoproxy
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testHostPort gives the HostPort of a test server
+func testHostPort(t *testing.T, serverURL string) HostPort {
+	t.Helper()
+	u, err := url.Parse(serverURL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	port, _ := strconv.Atoi(u.Port())
+	return HostPort{u.Hostname(), port}
+}
+
+// newTestProxy puts a proxy without Kerberos in front of the backends
+func newTestProxy(t *testing.T, backends ...HostPort) (*ProxyHandler, *httptest.Server) {
+	t.Helper()
+	pool := NewBackendPool(RoundRobin, nil)
+	pool.Update(backends)
+	h := NewProxyHandler(pool, false)
+	proxy := httptest.NewServer(h)
+	t.Cleanup(proxy.Close)
+	return h, proxy
+}
+
+func newTestBackend(t *testing.T, handler http.HandlerFunc) *httptest.Server {
+	t.Helper()
+	backend := httptest.NewServer(handler)
+	t.Cleanup(backend.Close)
+	return backend
+}
+
+// withCallbacks registers callbacks for the duration of a test
+func withCallbacks(t *testing.T, admission []RequestAdmissionCallback, inspection []RequestInspectionCallback) {
+	savedAdmission, savedInspection := requestAdmissionCallback, requestInspectionCallback
+	t.Cleanup(func() {
+		requestAdmissionCallback, requestInspectionCallback = savedAdmission, savedInspection
+	})
+	requestAdmissionCallback = append(slices.Clone(savedAdmission), admission...)
+	requestInspectionCallback = append(slices.Clone(savedInspection), inspection...)
+}
+
+// readRemoteException checks that res carries a RemoteException and returns it
+func readRemoteException(t *testing.T, res *http.Response) RemoteException {
+	t.Helper()
+	defer res.Body.Close()
+	var body struct {
+		RemoteException RemoteException
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err != nil || body.RemoteException.Exception == "" {
+		t.Fatalf("status %d without a RemoteException: %v", res.StatusCode, err)
+	}
+	if ct := res.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("RemoteException sent as %s", ct)
+	}
+	return body.RemoteException
+}
+
+func TestProxyCallbacksRunInOrder(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+	record := func(call string) {
+		mu.Lock()
+		defer mu.Unlock()
+		calls = append(calls, call)
+	}
+	takeCalls := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		taken := calls
+		calls = nil
+		return taken
+	}
+	backend := newTestBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		record("backend " + r.Header.Get("X-Inspected"))
+	})
+	withCallbacks(t,
+		[]RequestAdmissionCallback{
+			func(r *http.Request) *ProxyError {
+				record("admit 1")
+				return nil
+			},
+			func(r *http.Request) *ProxyError {
+				record("admit 2")
+				if r.URL.Query().Get("op") == "DELETE" {
+					return NewProxyError(http.StatusForbidden, "AccessControlException", "org.apache.hadoop.security.AccessControlException", "no deletes")
+				}
+				return nil
+			},
+			func(r *http.Request) *ProxyError {
+				record("admit 3")
+				return nil
+			},
+		},
+		[]RequestInspectionCallback{
+			func(r *http.Request) {
+				// inspection sees the request on its way to the backend
+				record("inspect " + r.URL.Host)
+				r.Header.Set("X-Inspected", "yes")
+			},
+		})
+	_, proxy := newTestProxy(t, testHostPort(t, backend.URL))
+	backendHost := testHostPort(t, backend.URL).f()
+
+	res, err := http.Get(proxy.URL + "/webhdfs/v1/a?op=LISTSTATUS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	want := []string{"admit 1", "admit 2", "admit 3", "inspect " + backendHost, "backend yes"}
+	if got := takeCalls(); res.StatusCode != http.StatusOK || !slices.Equal(got, want) {
+		t.Fatalf("status %d, calls %q, want 200 and %q", res.StatusCode, got, want)
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, proxy.URL+"/webhdfs/v1/a?op=DELETE", nil)
+	if res, err = http.DefaultClient.Do(req); err != nil {
+		t.Fatal(err)
+	}
+	// the first refusal stops the request
+	want = []string{"admit 1", "admit 2"}
+	if got := takeCalls(); res.StatusCode != http.StatusForbidden || !slices.Equal(got, want) {
+		t.Fatalf("status %d, calls %q, want 403 and %q", res.StatusCode, got, want)
+	}
+	if re := readRemoteException(t, res); re.Exception != "AccessControlException" || re.Message != "no deletes" {
+		t.Fatalf("got %+v", re)
+	}
+}
+
+func TestProxyStripsBackendAuthentication(t *testing.T) {
+	backend := newTestBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Www-Authenticate", "Negotiate oRQwEqADCgEAoQsGCSqGSIb3EgECAg==")
+		w.Header().Add("Set-Cookie", "hadoop.auth=\"u=proxy&p=proxy/host@REALM&t=kerberos&e=1&s=x\"; Path=/; HttpOnly")
+		w.Header().Add("Set-Cookie", "other=1")
+		w.Header().Set("X-Backend", "kept")
+		io.WriteString(w, `{"boolean":true}`)
+	})
+	_, proxy := newTestProxy(t, testHostPort(t, backend.URL))
+	res, err := http.Get(proxy.URL + "/webhdfs/v1/a?op=MKDIRS")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(res.Body)
+	res.Body.Close()
+	if v := res.Header.Values("Www-Authenticate"); len(v) > 0 {
+		t.Errorf("client got Www-Authenticate %q", v)
+	}
+	if v := res.Header.Values("Set-Cookie"); len(v) > 0 {
+		t.Errorf("client got Set-Cookie %q", v)
+	}
+	if res.Header.Get("X-Backend") != "kept" || string(body) != `{"boolean":true}` {
+		t.Errorf("answer changed: %v %s", res.Header, body)
+	}
+}
+
+func TestProxyUpstreamErrors(t *testing.T) {
+	// a port nothing listens on
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closedHost := testHostPort(t, closed.URL)
+	closed.Close()
+	hanging := newTestBackend(t, func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+		}
+	})
+	tests := []struct {
+		name      string
+		backend   HostPort
+		status    int
+		exception string
+	}{
+		{"connection refused", closedHost, http.StatusBadGateway, "ConnectException"},
+		{"timeout", testHostPort(t, hanging.URL), http.StatusGatewayTimeout, "SocketTimeoutException"},
+	}
+	for _, tt := range tests {
+		h, proxy := newTestProxy(t, tt.backend)
+		h.upstream.ResponseHeaderTimeout = 100 * time.Millisecond
+		res, err := http.Get(proxy.URL + "/webhdfs/v1/a?op=GETFILESTATUS")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, res.StatusCode, tt.status)
+		}
+		if re := readRemoteException(t, res); re.Exception != tt.exception {
+			t.Errorf("%s: %s, want %s", tt.name, re.Exception, tt.exception)
+		}
+	}
+}
+
+func TestProxyWithoutBackend(t *testing.T) {
+	backend := newTestBackend(t, func(w http.ResponseWriter, r *http.Request) {})
+	tests := []struct {
+		name  string
+		setup func(h *ProxyHandler)
+	}{
+		{"empty pool", func(h *ProxyHandler) { h.pool.Update(nil) }},
+		{"open circuit", func(h *ProxyHandler) {
+			h.pool.SetCircuitBreaker(BreakerSettings{FailureThreshold: 1, CoolDown: time.Minute})
+			b := h.pool.Backends()[0].breaker
+			b.mu.Lock()
+			b.trip("test")
+			b.mu.Unlock()
+		}},
+		{"unhealthy backend", func(h *ProxyHandler) { h.pool.Backends()[0].health.down.Store(true) }},
+	}
+	for _, tt := range tests {
+		h, proxy := newTestProxy(t, testHostPort(t, backend.URL))
+		tt.setup(h)
+		res, err := http.Get(proxy.URL + "/webhdfs/v1/a?op=GETFILESTATUS")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("%s: status %d, want %d", tt.name, res.StatusCode, http.StatusServiceUnavailable)
+		}
+		if re := readRemoteException(t, res); re.Message != ErrNoBackend.Error() {
+			t.Errorf("%s: message %q, want %q", tt.name, re.Message, ErrNoBackend)
+		}
+	}
+}
+
+// countConnections counts the connections a test server accepts
+func countConnections(s *httptest.Server) *atomic.Int32 {
+	var n atomic.Int32
+	s.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			n.Add(1)
+		}
+	}
+	return &n
+}
+
+func TestProxyKeepsConnectionsAlive(t *testing.T) {
+	backend := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.URL.Path)
+	}))
+	backendConns := countConnections(backend)
+	backend.Start()
+	t.Cleanup(backend.Close)
+	pool := NewBackendPool(RoundRobin, nil)
+	pool.Update([]HostPort{testHostPort(t, backend.URL)})
+	proxy := httptest.NewUnstartedServer(NewProxyHandler(pool, false))
+	clientConns := countConnections(proxy)
+	proxy.Start()
+	t.Cleanup(proxy.Close)
+
+	client := &http.Client{Transport: &http.Transport{MaxConnsPerHost: 1}}
+	defer client.CloseIdleConnections()
+	for i := 0; i < 5; i++ {
+		path := "/webhdfs/v1/f" + strconv.Itoa(i)
+		res, err := client.Get(proxy.URL + path + "?op=GETFILESTATUS")
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(res.Body)
+		res.Body.Close()
+		if string(body) != path {
+			t.Fatalf("request %d answered %q, want %q", i, body, path)
+		}
+	}
+	if n := clientConns.Load(); n != 1 {
+		t.Errorf("client opened %d connections to the proxy, want 1", n)
+	}
+	if n := backendConns.Load(); n != 1 {
+		t.Errorf("proxy opened %d connections to the backend, want 1", n)
+	}
+}
@@ -0,0 +1,190 @@
+package spnegoproxy
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// buckets of clients not seen for that long are dropped
+const RATE_LIMIT_BUCKET_IDLE_TTL = time.Minute * 10
+
+// RateLimit lets Rate requests per second through, with bursts of up to Burst requests
+type RateLimit struct {
+	Rate  float64
+	Burst float64
+}
+
+// ParseRateLimits reads limits such as "metadata=100:200,data=20,mutating=5", a rate per second
+// optionally followed by the burst, which defaults to the rate
+func ParseRateLimits(s string) (map[WebHDFSOpClass]RateLimit, error) {
+	limits := make(map[WebHDFSOpClass]RateLimit)
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		class, spec, ok := strings.Cut(item, "=")
+		if !ok || !isWebHDFSOpClass(WebHDFSOpClass(class)) {
+			return nil, fmt.Errorf("invalid rate limit %q (want <metadata|data|mutating>=<rate>[:<burst>])", item)
+		}
+		rateS, burstS, hasBurst := strings.Cut(spec, ":")
+		rate, err := strconv.ParseFloat(rateS, 64)
+		if err != nil || rate <= 0 {
+			return nil, fmt.Errorf("invalid rate in %q", item)
+		}
+		burst := math.Max(rate, 1)
+		if hasBurst {
+			if burst, err = strconv.ParseFloat(burstS, 64); err != nil || burst < 1 {
+				return nil, fmt.Errorf("invalid burst in %q", item)
+			}
+		}
+		limits[WebHDFSOpClass(class)] = RateLimit{rate, burst}
+	}
+	return limits, nil
+}
+
+func isWebHDFSOpClass(class WebHDFSOpClass) bool {
+	for _, c := range webHDFSOpClasses {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// take spends a token if there is one, and tells how long to wait for the next one otherwise
+func (b *tokenBucket) take(limit RateLimit, now time.Time) (bool, time.Duration) {
+	b.tokens = math.Min(limit.Burst, b.tokens+now.Sub(b.last).Seconds()*limit.Rate)
+	b.last = now
+	if b.tokens >= 1 {
+		b.tokens--
+		return true, 0
+	}
+	return false, time.Duration((1 - b.tokens) / limit.Rate * float64(time.Second))
+}
+
+// RateLimiter keeps one token bucket per client and operation class
+type RateLimiter struct {
+	limits     map[WebHDFSOpClass]RateLimit
+	byIdentity bool
+	mu         sync.Mutex
+	buckets    map[string]*tokenBucket
+	lastSweep  time.Time
+	allowed    map[WebHDFSOpClass]*atomic.Uint64
+	limited    map[WebHDFSOpClass]*atomic.Uint64
+}
+
+// NewRateLimiter builds a limiter telling clients apart by IP, or by end user when byIdentity is set
+// and the request has one
+func NewRateLimiter(limits map[WebHDFSOpClass]RateLimit, byIdentity bool) *RateLimiter {
+	l := &RateLimiter{
+		limits:     limits,
+		byIdentity: byIdentity,
+		buckets:    make(map[string]*tokenBucket),
+		lastSweep:  time.Now(),
+		allowed:    make(map[WebHDFSOpClass]*atomic.Uint64),
+		limited:    make(map[WebHDFSOpClass]*atomic.Uint64),
+	}
+	for _, class := range webHDFSOpClasses {
+		l.allowed[class] = new(atomic.Uint64)
+		l.limited[class] = new(atomic.Uint64)
+	}
+	return l
+}
+
+// EnableRateLimiting makes requests go through a RateLimiter, key being "ip" or "identity"
+func EnableRateLimiting(spec string, key string) error {
+	limits, err := ParseRateLimits(spec)
+	if err != nil {
+		return err
+	}
+	if key != "ip" && key != "identity" {
+		return fmt.Errorf("unknown rate limit key %q (want ip or identity)", key)
+	}
+	l := NewRateLimiter(limits, key == "identity")
+	registerMetricsSource(l.metrics)
+	RegisterRequestAdmissionCallback(l.Admit)
+	logger.Printf("Rate limiting clients by %s: %s", key, spec)
+	return nil
+}
+
+func (l *RateLimiter) clientKey(r *http.Request) string {
+	if identity := RequestIdentity(r); l.byIdentity && identity != "" {
+		return "user:" + identity
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// Admit is the RequestAdmissionCallback of the limiter
+func (l *RateLimiter) Admit(r *http.Request) *ProxyError {
+	event, _ := ClassifyWebHDFSRequest(r)
+	class := event.Class()
+	limit, ok := l.limits[class]
+	if !ok {
+		return nil
+	}
+	client := l.clientKey(r)
+	now := time.Now()
+	l.mu.Lock()
+	if now.Sub(l.lastSweep) > RATE_LIMIT_BUCKET_IDLE_TTL/2 {
+		l.sweep(now)
+	}
+	key := client + " " + string(class)
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: limit.Burst, last: now}
+		l.buckets[key] = b
+	}
+	allowed, wait := b.take(limit, now)
+	l.mu.Unlock()
+	if allowed {
+		l.allowed[class].Add(1)
+		return nil
+	}
+	l.limited[class].Add(1)
+	proxyErr := NewProxyError(http.StatusTooManyRequests, "RetriableException", "org.apache.hadoop.ipc.RetriableException",
+		fmt.Sprintf("Too many %s requests from %s, retry in %s", class, client, wait.Round(time.Millisecond)))
+	proxyErr.RetryAfter = wait
+	return proxyErr
+}
+
+// sweep drops the buckets of clients gone quiet, l.mu must be held
+func (l *RateLimiter) sweep(now time.Time) {
+	l.lastSweep = now
+	for key, b := range l.buckets {
+		if now.Sub(b.last) > RATE_LIMIT_BUCKET_IDLE_TTL {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func (l *RateLimiter) metrics() string {
+	l.mu.Lock()
+	buckets := len(l.buckets)
+	l.mu.Unlock()
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("proxy_rate_limit_buckets %d\n", buckets))
+	for _, class := range webHDFSOpClasses {
+		if _, ok := l.limits[class]; !ok {
+			continue
+		}
+		sb.WriteString(fmt.Sprintf("proxy_rate_limit_allowed_total{class=%q} %d\n", class, l.allowed[class].Load()))
+		sb.WriteString(fmt.Sprintf("proxy_rate_limited_total{class=%q} %d\n", class, l.limited[class].Load()))
+	}
+	return sb.String()
+}
@@ -0,0 +1,108 @@
+package spnegoproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketTake(t *testing.T) {
+	limit := RateLimit{Rate: 2, Burst: 3}
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+	b := &tokenBucket{tokens: limit.Burst, last: start}
+	steps := []struct {
+		after   time.Duration
+		allowed bool
+		wait    time.Duration
+	}{
+		// the burst goes through at once
+		{0, true, 0},
+		{0, true, 0},
+		{0, true, 0},
+		{0, false, 500 * time.Millisecond},
+		// half a token came in
+		{250 * time.Millisecond, false, 250 * time.Millisecond},
+		{500 * time.Millisecond, true, 0},
+		{500 * time.Millisecond, false, 500 * time.Millisecond},
+		{time.Second, true, 0},
+		{time.Second, false, 500 * time.Millisecond},
+		// a long pause refills up to the burst, not more
+		{time.Hour, true, 0},
+		{time.Hour, true, 0},
+		{time.Hour, true, 0},
+		{time.Hour, false, 500 * time.Millisecond},
+	}
+	for i, step := range steps {
+		allowed, wait := b.take(limit, start.Add(step.after))
+		if allowed != step.allowed || wait != step.wait {
+			t.Fatalf("take %d at +%s: allowed = %v wait = %s, want %v and %s", i+1, step.after, allowed, wait, step.allowed, step.wait)
+		}
+	}
+}
+
+func TestParseRateLimits(t *testing.T) {
+	tests := []struct {
+		spec string
+		want map[WebHDFSOpClass]RateLimit
+	}{
+		{"", map[WebHDFSOpClass]RateLimit{}},
+		{"metadata=100:200, data=20", map[WebHDFSOpClass]RateLimit{
+			WebHDFSMetadataClass: {100, 200},
+			WebHDFSDataClass:     {20, 20},
+		}},
+		// at least one request goes through
+		{"mutating=0.5", map[WebHDFSOpClass]RateLimit{WebHDFSMutatingClass: {0.5, 1}}},
+		{"mutating=5:0.5", nil},
+		{"mutating=0", nil},
+		{"mutating=fast", nil},
+		{"other=5", nil},
+		{"metadata", nil},
+	}
+	for _, tt := range tests {
+		got, err := ParseRateLimits(tt.spec)
+		if tt.want == nil {
+			if err == nil {
+				t.Errorf("%q: parsed as %v, want an error", tt.spec, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", tt.spec, err)
+			continue
+		}
+		if len(got) != len(tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.spec, got, tt.want)
+		}
+		for class, limit := range tt.want {
+			if got[class] != limit {
+				t.Errorf("%q: %s limit %v, want %v", tt.spec, class, got[class], limit)
+			}
+		}
+	}
+}
+
+func TestRateLimiterAdmit(t *testing.T) {
+	l := NewRateLimiter(map[WebHDFSOpClass]RateLimit{WebHDFSMutatingClass: {Rate: 1, Burst: 1}}, false)
+	request := func(method, target, remoteAddr string) *http.Request {
+		r := httptest.NewRequest(method, target, nil)
+		r.RemoteAddr = remoteAddr
+		return r
+	}
+	if proxyErr := l.Admit(request(http.MethodPut, "/webhdfs/v1/a?op=MKDIRS", "192.0.2.1:1000")); proxyErr != nil {
+		t.Fatalf("first request refused: %s", proxyErr)
+	}
+	proxyErr := l.Admit(request(http.MethodPut, "/webhdfs/v1/b?op=MKDIRS", "192.0.2.1:2000"))
+	if proxyErr == nil || proxyErr.StatusCode != http.StatusTooManyRequests || proxyErr.RetryAfter <= 0 {
+		t.Fatalf("second request from the same client: %v, want a 429 with a retry delay", proxyErr)
+	}
+	if proxyErr := l.Admit(request(http.MethodPut, "/webhdfs/v1/b?op=MKDIRS", "192.0.2.2:1000")); proxyErr != nil {
+		t.Fatalf("request from another client refused: %s", proxyErr)
+	}
+	// classes without a limit are not counted
+	for i := 0; i < 5; i++ {
+		if proxyErr := l.Admit(request(http.MethodGet, "/webhdfs/v1/a?op=LISTSTATUS", "192.0.2.1:1000")); proxyErr != nil {
+			t.Fatalf("unlimited request refused: %s", proxyErr)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package spnegoproxy
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// readOnlyGuard refuses every request that is not a known WebHDFS read
+type readOnlyGuard struct {
+	mu       sync.Mutex
+	rejected map[string]uint64
+}
+
+// reads refused all the same: a delegation token of the proxy principal lets clients write to HDFS directly
+var readOnlyRefusedEvents = map[WebHDFSEvent]bool{
+	WebHDFSGetGetDelegationToken:    true,
+	WebHDFSPutRenewDelegationToken:  true,
+	WebHDFSPutCancelDelegationToken: true,
+}
+
+func newReadOnlyGuard() *readOnlyGuard {
+	return &readOnlyGuard{rejected: make(map[string]uint64)}
+}
+
+// EnableReadOnly makes the proxy refuse all PUT, POST and DELETE operations, delegation token operations
+// and any operation it does not know
+func EnableReadOnly() {
+	g := newReadOnlyGuard()
+	registerMetricsSource(g.metrics)
+	RegisterRequestAdmissionCallback(g.admit)
+	logger.Print("Read-only mode, mutating operations are refused")
+}
+
+func (g *readOnlyGuard) admit(r *http.Request) *ProxyError {
+	event, err := ClassifyWebHDFSRequest(r)
+	if err == nil && event.Verb() == WebHDFSGet && !readOnlyRefusedEvents[event] {
+		return nil
+	}
+	op := string(event.Op())
+	if op == "" {
+		op = "NONE"
+	}
+	g.mu.Lock()
+	g.rejected[r.Method+" "+op]++
+	g.mu.Unlock()
+	return NewProxyError(http.StatusForbidden, "AccessControlException", "org.apache.hadoop.security.AccessControlException",
+		fmt.Sprintf("This proxy is read-only, %s op=%s is not allowed", r.Method, op))
+}
+
+func (g *readOnlyGuard) metrics() string {
+	g.mu.Lock()
+	keys := make([]string, 0, len(g.rejected))
+	for k := range g.rejected {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var sb strings.Builder
+	for _, k := range keys {
+		method, op, _ := strings.Cut(k, " ")
+		sb.WriteString(fmt.Sprintf("proxy_readonly_rejected_total{method=%q,op=%q} %d\n", method, op, g.rejected[k]))
+	}
+	g.mu.Unlock()
+	return sb.String()
+}
@@ -0,0 +1,39 @@
+package spnegoproxy
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestReadOnlyAdmit(t *testing.T) {
+	tests := []struct {
+		method  string
+		target  string
+		allowed bool
+	}{
+		{http.MethodGet, "/webhdfs/v1/data?op=LISTSTATUS", true},
+		{http.MethodGet, "/webhdfs/v1/data/file?op=OPEN", true},
+		{http.MethodGet, "/webhdfs/v1/data?Op=GetFileStatus", true},
+		{http.MethodGet, "/webhdfs/v1/?op=GETDELEGATIONTOKEN&renewer=alice", false},
+		{http.MethodGet, "/webhdfs/v1/?OP=GETDELEGATIONTOKEN", false},
+		{http.MethodPut, "/webhdfs/v1/?op=RENEWDELEGATIONTOKEN&token=x", false},
+		{http.MethodPut, "/webhdfs/v1/?op=CANCELDELEGATIONTOKEN&token=x", false},
+		{http.MethodPut, "/webhdfs/v1/data?op=MKDIRS", false},
+		{http.MethodPost, "/webhdfs/v1/data/file?op=APPEND", false},
+		{http.MethodDelete, "/webhdfs/v1/data?op=DELETE", false},
+		{http.MethodGet, "/webhdfs/v1/data?op=NOSUCHOP", false},
+		{http.MethodGet, "/webhdfs/v1/data", false},
+		{http.MethodGet, "/webhdfs/v1/data?op=LISTSTATUS&OP=GETDELEGATIONTOKEN", false},
+	}
+	g := newReadOnlyGuard()
+	for _, tt := range tests {
+		proxyErr := g.admit(httptest.NewRequest(tt.method, tt.target, nil))
+		if allowed := proxyErr == nil; allowed != tt.allowed {
+			t.Errorf("%s %s: allowed = %v, want %v (%v)", tt.method, tt.target, allowed, tt.allowed, proxyErr)
+		}
+		if proxyErr != nil && proxyErr.StatusCode != http.StatusForbidden {
+			t.Errorf("%s %s: status %d, want %d", tt.method, tt.target, proxyErr.StatusCode, http.StatusForbidden)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package spnegoproxy
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"time"
+)
+
+// how long we wait for the backend to accept a TCP connection
+const UPSTREAM_DIAL_TIMEOUT = time.Second * 10
+
+// RemoteException is the error body WebHDFS servers send, Hadoop clients turn it into a Java exception
+type RemoteException struct {
+	Exception     string `json:"exception"`
+	JavaClassName string `json:"javaClassName"`
+	Message       string `json:"message"`
+}
+
+// ProxyError is an error the proxy answers with instead of a backend response
+type ProxyError struct {
+	StatusCode int
+	RemoteException
+	// sent as Retry-After when set
+	RetryAfter time.Duration
+}
+
+func NewProxyError(statusCode int, exception string, javaClassName string, message string) *ProxyError {
+	return &ProxyError{StatusCode: statusCode, RemoteException: RemoteException{exception, javaClassName, message}}
+}
+
+func (e *ProxyError) setHeaders(header http.Header, body []byte) {
+	header.Set("Content-Type", "application/json")
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	if e.RetryAfter > 0 {
+		header.Set("Retry-After", strconv.Itoa(int(math.Ceil(e.RetryAfter.Seconds()))))
+	}
+}
+
+func (e *ProxyError) Error() string {
+	return fmt.Sprintf("%d %s: %s", e.StatusCode, e.Exception, e.Message)
+}
+
+func (e *ProxyError) body() []byte {
+	b, _ := json.Marshal(struct {
+		RemoteException RemoteException `json:"RemoteException"`
+	}{e.RemoteException})
+	return b
+}
+
+func (e *ProxyError) writeResponse(w http.ResponseWriter) {
+	body := e.body()
+	e.setHeaders(w.Header(), body)
+	w.WriteHeader(e.StatusCode)
+	w.Write(body)
+}
+
+// upstreamError maps a failure to reach the backend to 504 on timeouts and 502 otherwise
+func upstreamError(backend string, err error) *ProxyError {
+	var netErr net.Error
+	var dnsErr *net.DNSError
+	var certErr *tls.CertificateVerificationError
+	var alertErr tls.AlertError
+	var recordErr tls.RecordHeaderError
+	switch {
+	case errors.As(err, &dnsErr):
+		return NewProxyError(http.StatusBadGateway, "UnknownHostException", "java.net.UnknownHostException",
+			fmt.Sprintf("cannot resolve backend %s: %s", backend, err))
+	case errors.As(err, &certErr), errors.As(err, &alertErr), errors.As(err, &recordErr):
+		return NewProxyError(http.StatusBadGateway, "SSLHandshakeException", "javax.net.ssl.SSLHandshakeException",
+			fmt.Sprintf("TLS handshake with backend %s failed: %s", backend, err))
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return NewProxyError(http.StatusGatewayTimeout, "SocketTimeoutException", "java.net.SocketTimeoutException",
+			fmt.Sprintf("timeout talking to backend %s: %s", backend, err))
+	default:
+		return NewProxyError(http.StatusBadGateway, "ConnectException", "java.net.ConnectException",
+			fmt.Sprintf("cannot talk to backend %s: %s", backend, err))
+	}
+}
+
+// recoverPanic keeps a panic while serving a client from taking the whole proxy down
+func recoverPanic(what string) {
+	if r := recover(); r != nil {
+		if r == http.ErrAbortHandler {
+			// net/http uses this panic to abort a response on purpose
+			panic(r)
+		}
+		logger.Printf("recovered from panic while %s: %v\n%s", what, r, debug.Stack())
+	}
+}
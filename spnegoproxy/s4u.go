@@ -0,0 +1,279 @@
+package spnegoproxy
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/matchaxnb/gokrb5/v8/client"
+	"github.com/matchaxnb/gokrb5/v8/crypto"
+	"github.com/matchaxnb/gokrb5/v8/crypto/rfc4757"
+	"github.com/matchaxnb/gokrb5/v8/iana/chksumtype"
+	"github.com/matchaxnb/gokrb5/v8/iana/flags"
+	"github.com/matchaxnb/gokrb5/v8/iana/keyusage"
+	"github.com/matchaxnb/gokrb5/v8/iana/nametype"
+	"github.com/matchaxnb/gokrb5/v8/iana/patype"
+	"github.com/matchaxnb/gokrb5/v8/messages"
+	"github.com/matchaxnb/gokrb5/v8/types"
+)
+
+// end users without requests for that long have their delegated tickets dropped
+const S4U_USER_IDLE_TTL = time.Minute * 30
+
+// KDC option asking the KDC to take the client of the ticket in additional-tickets, for S4U2Proxy (MS-SFU)
+const kdcOptionCNameInAddlTkt = 14
+
+// key usage of the PA-FOR-USER checksum (MS-SFU 2.2.1)
+const keyUsagePAForUserChecksum = 17
+
+// paForUser is the PA-FOR-USER padata of S4U2Self, naming the user the ticket is wanted for
+type paForUser struct {
+	UserName    types.PrincipalName `asn1:"explicit,tag:0"`
+	UserRealm   string              `asn1:"generalstring,explicit,tag:1"`
+	Cksum       types.Checksum      `asn1:"explicit,tag:2"`
+	AuthPackage string              `asn1:"generalstring,explicit,tag:3"`
+}
+
+// s4uDelegator gets service tickets on behalf of end users with the proxy principal's TGT. Each user has
+// a client of its own holding its tickets, so that they never mix with the proxy's ticket cache.
+type s4uDelegator struct {
+	mu        sync.Mutex
+	krbClient *client.Client
+	users     map[string]*s4uUser
+	lastSweep time.Time
+	self      atomic.Uint64
+	proxy     atomic.Uint64
+	failures  atomic.Uint64
+}
+
+type s4uUser struct {
+	mu       sync.Mutex
+	client   *client.Client
+	lastUsed time.Time
+}
+
+func newS4UDelegator(krbClient *client.Client) *s4uDelegator {
+	d := &s4uDelegator{krbClient: krbClient, users: make(map[string]*s4uUser), lastSweep: time.Now()}
+	registerMetricsSource(d.metrics)
+	return d
+}
+
+// setKrbClient switches to a new proxy client, the tickets obtained with the previous one are dropped
+func (d *s4uDelegator) setKrbClient(krbClient *client.Client) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.krbClient = krbClient
+	d.users = make(map[string]*s4uUser)
+}
+
+// user returns the client of the end user, as user or user@REALM
+func (d *s4uDelegator) user(name string) (*s4uUser, *client.Client) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	now := time.Now()
+	if now.Sub(d.lastSweep) > S4U_USER_IDLE_TTL/2 {
+		d.lastSweep = now
+		for n, u := range d.users {
+			if now.Sub(u.lastUsed) > S4U_USER_IDLE_TTL {
+				delete(d.users, n)
+			}
+		}
+	}
+	u, ok := d.users[name]
+	if !ok {
+		userName, realm, found := strings.Cut(name, "@")
+		if !found {
+			realm = d.krbClient.Credentials.Domain()
+		}
+		// never logged in, this client only carries the user name and caches the user's tickets
+		u = &s4uUser{client: client.NewWithPassword(userName, realm, "", d.krbClient.Config, client.Logger(logger))}
+		d.users[name] = u
+	}
+	u.lastUsed = now
+	return u, d.krbClient
+}
+
+// serviceTicket returns a ticket for spn in the name of user, along with the client to build the AP-REQ with
+func (d *s4uDelegator) serviceTicket(user string, spn string) (messages.Ticket, types.EncryptionKey, *client.Client, error) {
+	u, proxyCl := d.user(user)
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if tkt, key, ok := u.client.GetCachedTicket(spn); ok {
+		return tkt, key, u.client, nil
+	}
+	realm := proxyCl.Credentials.Domain()
+	tgt, tgtKey, err := proxyCl.GetServiceTicket("krbtgt/" + realm)
+	if err != nil {
+		d.failures.Add(1)
+		return tgt, tgtKey, nil, fmt.Errorf("cannot get a TGT for S4U: %w", err)
+	}
+	proxyName := proxyCl.Credentials.CName()
+	evidence, _, ok := u.client.GetCachedTicket(proxyName.PrincipalNameString())
+	if !ok {
+		if evidence, err = d.s4u2self(u.client, proxyCl, tgt, tgtKey); err != nil {
+			d.failures.Add(1)
+			return tgt, tgtKey, nil, fmt.Errorf("S4U2Self for %s failed: %w", user, err)
+		}
+	}
+	tkt, key, err := d.s4u2proxy(u.client, proxyCl, tgt, tgtKey, evidence, spn)
+	if err != nil {
+		d.failures.Add(1)
+		return tkt, key, nil, fmt.Errorf("S4U2Proxy for %s to %s failed: %w", user, spn, err)
+	}
+	return tkt, key, u.client, nil
+}
+
+// s4u2self gets a ticket to the proxy principal in the name of the user, the evidence needed by S4U2Proxy
+func (d *s4uDelegator) s4u2self(userCl *client.Client, proxyCl *client.Client, tgt messages.Ticket, tgtKey types.EncryptionKey) (messages.Ticket, error) {
+	realm := proxyCl.Credentials.Domain()
+	req, err := s4uTGSReq(userCl, proxyCl, realm, proxyCl.Credentials.CName(), tgt, tgtKey)
+	if err != nil {
+		return messages.Ticket{}, err
+	}
+	forUser, err := newPAForUser(userCl.Credentials.CName(), userCl.Credentials.Domain(), tgtKey)
+	if err != nil {
+		return messages.Ticket{}, err
+	}
+	if err := signTGSReq(&req, proxyCl.Credentials.CName(), tgt, tgtKey); err != nil {
+		return messages.Ticket{}, err
+	}
+	req.PAData = append(req.PAData, types.PAData{PADataType: patype.PA_FOR_USER, PADataValue: forUser})
+	_, rep, err := userCl.TGSExchange(req, realm, tgt, tgtKey, 0)
+	if err != nil {
+		return messages.Ticket{}, err
+	}
+	if !types.IsFlagSet(&rep.DecryptedEncPart.Flags, flags.Forwardable) {
+		return messages.Ticket{}, fmt.Errorf("the KDC did not make the ticket forwardable, %s may not be allowed to delegate", proxyCl.Credentials.CName().PrincipalNameString())
+	}
+	d.self.Add(1)
+	return rep.Ticket, nil
+}
+
+// s4u2proxy exchanges the evidence ticket for a ticket to spn in the name of the user
+func (d *s4uDelegator) s4u2proxy(userCl *client.Client, proxyCl *client.Client, tgt messages.Ticket, tgtKey types.EncryptionKey, evidence messages.Ticket, spn string) (messages.Ticket, types.EncryptionKey, error) {
+	realm := proxyCl.Credentials.Domain()
+	req, err := s4uTGSReq(userCl, proxyCl, realm, types.NewPrincipalName(nametype.KRB_NT_SRV_INST, spn), tgt, tgtKey)
+	if err != nil {
+		return messages.Ticket{}, types.EncryptionKey{}, err
+	}
+	req.ReqBody.AdditionalTickets = []messages.Ticket{evidence}
+	types.SetFlag(&req.ReqBody.KDCOptions, kdcOptionCNameInAddlTkt)
+	if err := signTGSReq(&req, proxyCl.Credentials.CName(), tgt, tgtKey); err != nil {
+		return messages.Ticket{}, types.EncryptionKey{}, err
+	}
+	_, rep, err := userCl.TGSExchange(req, realm, tgt, tgtKey, 0)
+	if err != nil {
+		return messages.Ticket{}, types.EncryptionKey{}, err
+	}
+	d.proxy.Add(1)
+	return rep.Ticket, rep.DecryptedEncPart.Key, nil
+}
+
+// s4uTGSReq builds a forwardable TGS-REQ whose body names the user, as gokrb5 checks the reply against it
+func s4uTGSReq(userCl *client.Client, proxyCl *client.Client, realm string, sname types.PrincipalName, tgt messages.Ticket, tgtKey types.EncryptionKey) (messages.TGSReq, error) {
+	req, err := messages.NewTGSReq(proxyCl.Credentials.CName(), realm, proxyCl.Config, tgt, tgtKey, sname, false)
+	if err != nil {
+		return req, err
+	}
+	// the PA-TGS-REQ is computed again once the body is complete
+	req.PAData = nil
+	req.ReqBody.CName = userCl.Credentials.CName()
+	types.SetFlag(&req.ReqBody.KDCOptions, flags.Forwardable)
+	return req, nil
+}
+
+// signTGSReq sets the PA-TGS-REQ of req, authenticating the proxy principal with its TGT over the final body
+func signTGSReq(req *messages.TGSReq, proxyName types.PrincipalName, tgt messages.Ticket, tgtKey types.EncryptionKey) error {
+	body, err := req.ReqBody.Marshal()
+	if err != nil {
+		return fmt.Errorf("cannot marshal TGS-REQ body: %w", err)
+	}
+	et, err := crypto.GetEtype(tgtKey.KeyType)
+	if err != nil {
+		return err
+	}
+	cksum, err := et.GetChecksumHash(tgtKey.KeyValue, body, keyusage.TGS_REQ_PA_TGS_REQ_AP_REQ_AUTHENTICATOR_CHKSUM)
+	if err != nil {
+		return err
+	}
+	auth, err := types.NewAuthenticator(tgt.Realm, proxyName)
+	if err != nil {
+		return err
+	}
+	auth.Cksum = types.Checksum{CksumType: et.GetHashID(), Checksum: cksum}
+	apReq, err := messages.NewAPReq(tgt, tgtKey, auth)
+	if err != nil {
+		return err
+	}
+	b, err := apReq.Marshal()
+	if err != nil {
+		return err
+	}
+	req.PAData = append(types.PADataSequence{{PADataType: patype.PA_TGS_REQ, PADataValue: b}}, req.PAData...)
+	return nil
+}
+
+// newPAForUser builds the PA-FOR-USER of user, checksummed with HMAC-MD5 under the TGT session key
+func newPAForUser(user types.PrincipalName, realm string, tgtKey types.EncryptionKey) ([]byte, error) {
+	const authPackage = "Kerberos"
+	data := binary.LittleEndian.AppendUint32(nil, uint32(user.NameType))
+	for _, s := range user.NameString {
+		data = append(data, s...)
+	}
+	data = append(data, realm...)
+	data = append(data, authPackage...)
+	cksum, err := rfc4757.Checksum(tgtKey.KeyValue, keyUsagePAForUserChecksum, data)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(paForUser{
+		UserName:    user,
+		UserRealm:   realm,
+		Cksum:       types.Checksum{CksumType: chksumtype.KERB_CHECKSUM_HMAC_MD5, Checksum: cksum},
+		AuthPackage: authPackage,
+	})
+}
+
+func (d *s4uDelegator) metrics() string {
+	d.mu.Lock()
+	users := len(d.users)
+	d.mu.Unlock()
+	return fmt.Sprintf("s4u_users_cached %d\n", users) +
+		fmt.Sprintf("s4u_tickets_total{step=\"self\"} %d\n", d.self.Load()) +
+		fmt.Sprintf("s4u_tickets_total{step=\"proxy\"} %d\n", d.proxy.Load()) +
+		fmt.Sprintf("s4u_failures_total %d\n", d.failures.Load())
+}
+
+// EnableS4U makes the SPNEGO clients of the registry able to authenticate as end users with S4U2Self and S4U2Proxy
+func (r *SPNEGOClientRegistry) EnableS4U() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.delegator == nil {
+		r.delegator = newS4UDelegator(r.krbClient)
+	}
+	for _, e := range r.entries {
+		e.client.delegator = r.delegator
+	}
+}
+
+// getDelegatedToken builds a SPNEGO token authenticating user rather than the proxy principal
+func (c *SPNEGOClient) getDelegatedToken(user string) (string, *secContext, error) {
+	tkt, key, userCl, err := c.delegator.serviceTicket(user, c.spn)
+	if err != nil {
+		c.failures.Add(1)
+		return "", nil, err
+	}
+	b, sc, err := newKRB5SPNEGOToken(userCl, tkt, key, c.mutualAuth)
+	if err != nil {
+		c.failures.Add(1)
+		return "", nil, err
+	}
+	c.tokens.Add(1)
+	c.lastToken.Store(time.Now().Unix())
+	return base64.StdEncoding.EncodeToString(b), sc, nil
+}
@@ -0,0 +1,83 @@
+package spnegoproxy
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/binary"
+	"slices"
+	"testing"
+
+	"github.com/jcmturner/gofork/encoding/asn1"
+	"github.com/matchaxnb/gokrb5/v8/iana/chksumtype"
+	"github.com/matchaxnb/gokrb5/v8/iana/etypeID"
+	"github.com/matchaxnb/gokrb5/v8/iana/nametype"
+	"github.com/matchaxnb/gokrb5/v8/types"
+)
+
+// hmacMD5 is the KERB_CHECKSUM_HMAC_MD5 checksum of RFC 4757, written out to check the one we send
+func hmacMD5(key []byte, usage uint32, data []byte) []byte {
+	mac := hmac.New(md5.New, key)
+	mac.Write([]byte("signaturekey\x00"))
+	ksign := mac.Sum(nil)
+	h := md5.New()
+	h.Write(binary.LittleEndian.AppendUint32(nil, usage))
+	h.Write(data)
+	mac = hmac.New(md5.New, ksign)
+	mac.Write(h.Sum(nil))
+	return mac.Sum(nil)
+}
+
+func TestNewPAForUser(t *testing.T) {
+	tgtKey := types.EncryptionKey{KeyType: etypeID.AES256_CTS_HMAC_SHA1_96, KeyValue: bytes.Repeat([]byte{0x42}, 32)}
+	tests := []struct {
+		user  types.PrincipalName
+		realm string
+		// what MS-SFU has the checksum cover
+		signed string
+	}{
+		{
+			types.PrincipalName{NameType: nametype.KRB_NT_PRINCIPAL, NameString: []string{"alice"}},
+			"EXAMPLE.COM",
+			"\x01\x00\x00\x00aliceEXAMPLE.COMKerberos",
+		},
+		{
+			types.PrincipalName{NameType: nametype.KRB_NT_ENTERPRISE, NameString: []string{"alice@corp.example.com"}},
+			"EXAMPLE.COM",
+			"\x0a\x00\x00\x00alice@corp.example.comEXAMPLE.COMKerberos",
+		},
+		{
+			types.PrincipalName{NameType: nametype.KRB_NT_SRV_INST, NameString: []string{"HTTP", "web.example.com"}},
+			"OTHER.EXAMPLE.COM",
+			"\x02\x00\x00\x00HTTPweb.example.comOTHER.EXAMPLE.COMKerberos",
+		},
+	}
+	for _, tt := range tests {
+		b, err := newPAForUser(tt.user, tt.realm, tgtKey)
+		if err != nil {
+			t.Fatalf("%v: %s", tt.user.NameString, err)
+		}
+		var pa paForUser
+		if rest, err := asn1.Unmarshal(b, &pa); err != nil || len(rest) > 0 {
+			t.Fatalf("%v: cannot read PA-FOR-USER back: %v", tt.user.NameString, err)
+		}
+		if pa.UserName.NameType != tt.user.NameType || !slices.Equal(pa.UserName.NameString, tt.user.NameString) {
+			t.Errorf("%v: user %v, want %v", tt.user.NameString, pa.UserName, tt.user)
+		}
+		if pa.UserRealm != tt.realm || pa.AuthPackage != "Kerberos" {
+			t.Errorf("%v: realm %q auth package %q, want %q and Kerberos", tt.user.NameString, pa.UserRealm, pa.AuthPackage, tt.realm)
+		}
+		// KerberosString and the auth package are GeneralStrings
+		for _, s := range []string{tt.realm, "Kerberos"} {
+			if !bytes.Contains(b, append([]byte{asn1.TagGeneralString, byte(len(s))}, s...)) {
+				t.Errorf("%v: %s is not encoded as a GeneralString", tt.user.NameString, s)
+			}
+		}
+		if pa.Cksum.CksumType != chksumtype.KERB_CHECKSUM_HMAC_MD5 {
+			t.Errorf("%v: checksum type %d, want %d", tt.user.NameString, pa.Cksum.CksumType, chksumtype.KERB_CHECKSUM_HMAC_MD5)
+		}
+		if want := hmacMD5(tgtKey.KeyValue, keyUsagePAForUserChecksum, []byte(tt.signed)); !bytes.Equal(pa.Cksum.Checksum, want) {
+			t.Errorf("%v: checksum %x, want %x", tt.user.NameString, pa.Cksum.Checksum, want)
+		}
+	}
+}
@@ -0,0 +1,197 @@
+package spnegoproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how often the certificate files are checked for a rotation, at most
+const CERT_RELOAD_CHECK_INTERVAL = time.Second * 10
+
+// ServerTLSOptions configures TLS on the listening socket
+type ServerTLSOptions struct {
+	CertFile string
+	KeyFile  string
+	// PEM bundle of the CAs client certificates must be signed by, no client certificate is asked when empty
+	ClientCAFile string
+	// "require" (the default) or "optional", used when ClientCAFile is set
+	ClientAuth string
+	// "1.0", "1.1", "1.2" (the default) or "1.3"
+	MinVersion string
+	// comma separated names of the TLS 1.0-1.2 cipher suites to accept, Go defaults when empty
+	CipherSuites string
+}
+
+func (o ServerTLSOptions) Enabled() bool {
+	return o.CertFile != ""
+}
+
+// WrapTLSListener terminates TLS on l when opts are enabled, and returns l as is otherwise
+func WrapTLSListener(l net.Listener, opts ServerTLSOptions) (net.Listener, error) {
+	if !opts.Enabled() {
+		return l, nil
+	}
+	tlsConfig, err := BuildServerTLSConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	logger.Printf("Serving TLS with certificate %s", opts.CertFile)
+	return tls.NewListener(l, tlsConfig), nil
+}
+
+func BuildServerTLSConfig(opts ServerTLSOptions) (*tls.Config, error) {
+	if opts.KeyFile == "" {
+		return nil, errors.New("a TLS key file is needed along with the certificate")
+	}
+	reloader := &certReloader{certFile: opts.CertFile, keyFile: opts.KeyFile}
+	if err := reloader.load(); err != nil {
+		return nil, err
+	}
+	minVersion, err := parseTLSVersion(opts.MinVersion)
+	if err != nil {
+		return nil, err
+	}
+	cipherSuites, err := parseCipherSuites(opts.CipherSuites)
+	if err != nil {
+		return nil, err
+	}
+	tlsConfig := &tls.Config{
+		GetCertificate: reloader.getCertificate,
+		MinVersion:     minVersion,
+		CipherSuites:   cipherSuites,
+		NextProtos:     []string{"http/1.1"},
+	}
+	if opts.ClientCAFile != "" {
+		pool, err := loadCertPool(opts.ClientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.ClientCAs = pool
+		switch strings.ToLower(opts.ClientAuth) {
+		case "", "require":
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+		case "optional":
+			tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+		default:
+			return nil, fmt.Errorf("unknown client auth mode %q (want require or optional)", opts.ClientAuth)
+		}
+	}
+	return tlsConfig, nil
+}
+
+func parseTLSVersion(s string) (uint16, error) {
+	switch s {
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("unknown TLS version %q (want 1.0, 1.1, 1.2 or 1.3)", s)
+	}
+}
+
+func parseCipherSuites(s string) ([]uint16, error) {
+	if s == "" {
+		return nil, nil
+	}
+	byName := make(map[string]uint16)
+	for _, suite := range tls.CipherSuites() {
+		byName[suite.Name] = suite.ID
+	}
+	var ids []uint16
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		id, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown or insecure cipher suite %q", name)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read CA bundle: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificate found in CA bundle %s", caFile)
+	}
+	return pool, nil
+}
+
+// certReloader serves a certificate and key pair, loading it again when the files change
+type certReloader struct {
+	certFile  string
+	keyFile   string
+	mu        sync.Mutex
+	cert      *tls.Certificate
+	modTime   time.Time
+	lastCheck time.Time
+}
+
+func (c *certReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, f := range []string{c.certFile, c.keyFile} {
+		st, err := os.Stat(f)
+		if err != nil {
+			return latest, err
+		}
+		if st.ModTime().After(latest) {
+			latest = st.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+func (c *certReloader) load() error {
+	modTime, err := c.filesModTime()
+	if err != nil {
+		return fmt.Errorf("cannot stat TLS certificate: %w", err)
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return fmt.Errorf("cannot load TLS certificate: %w", err)
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.cert, c.modTime, c.lastCheck = &cert, modTime, time.Now()
+	return nil
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.mu.Lock()
+	check := time.Since(c.lastCheck) > CERT_RELOAD_CHECK_INTERVAL
+	if check {
+		c.lastCheck = time.Now()
+	}
+	current, currentModTime := c.cert, c.modTime
+	c.mu.Unlock()
+	if check {
+		if modTime, err := c.filesModTime(); err == nil && !modTime.Equal(currentModTime) {
+			// a rotation may be half written, keep the current certificate until the new pair loads
+			if err := c.load(); err != nil {
+				logger.Printf("Keeping the current TLS certificate: %s", err)
+			} else {
+				logger.Printf("Reloaded TLS certificate %s", c.certFile)
+				c.mu.Lock()
+				current = c.cert
+				c.mu.Unlock()
+			}
+		}
+	}
+	return current, nil
+}
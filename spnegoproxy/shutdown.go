@@ -0,0 +1,57 @@
+package spnegoproxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// how long active requests get to finish once shutdown starts, by default
+const DEFAULT_DRAIN_TIMEOUT = time.Second * 30
+
+// ServeUntilSignal serves on listener until SIGTERM or SIGINT. It then runs beforeDrain, stops accepting
+// connections, waits up to drainTimeout for active requests to finish and writes the final metrics to the log.
+// It returns the exit status: 0 when every request finished, 1 when some had to be cut or serving failed.
+func ServeUntilSignal(server *http.Server, listener net.Listener, drainTimeout time.Duration, beforeDrain ...func() error) int {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	defer signal.Stop(signals)
+	served := make(chan error, 1)
+	go func() { served <- server.Serve(listener) }()
+
+	status := 0
+	select {
+	case err := <-served:
+		logger.Printf("Serving failed: %s", err)
+		status = 1
+	case sig := <-signals:
+		logger.Printf("Got %s, draining connections for up to %s", sig, drainTimeout)
+		for _, f := range beforeDrain {
+			if err := f(); err != nil {
+				logger.Printf("Shutdown step failed: %s", err)
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), drainTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			logger.Printf("Requests still active after %s, cutting them: %s", drainTimeout, err)
+			server.Close()
+			status = 1
+		} else {
+			logger.Print("All requests finished")
+		}
+		if err := <-served; err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Printf("Serving failed: %s", err)
+			status = 1
+		}
+	}
+	logger.Print("Final metrics:")
+	WriteMetrics(logger.Writer())
+	logger.Printf("Exiting with status %d", status)
+	return status
+}
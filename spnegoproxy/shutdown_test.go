@@ -0,0 +1,166 @@
+package spnegoproxy
+
+import (
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// slowServer answers once release is closed, telling on started when a request comes in
+type slowServer struct {
+	server   *http.Server
+	listener net.Listener
+	started  chan struct{}
+	release  chan struct{}
+}
+
+func newSlowServer(t *testing.T) *slowServer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &slowServer{listener: listener, started: make(chan struct{}, 1), release: make(chan struct{})}
+	s.server = &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.started <- struct{}{}
+		select {
+		case <-s.release:
+			io.WriteString(w, "done")
+		case <-r.Context().Done():
+		}
+	})}
+	t.Cleanup(func() {
+		s.server.Close()
+		listener.Close()
+	})
+	return s
+}
+
+type getResult struct {
+	body string
+	err  error
+}
+
+// get sends a request to the server in the background and waits for it to reach the handler
+func (s *slowServer) get(t *testing.T) <-chan getResult {
+	t.Helper()
+	result := make(chan getResult, 1)
+	go func() {
+		res, err := http.Get("http://" + s.listener.Addr().String() + "/webhdfs/v1/a?op=OPEN")
+		if err != nil {
+			result <- getResult{err: err}
+			return
+		}
+		defer res.Body.Close()
+		body, err := io.ReadAll(res.Body)
+		result <- getResult{string(body), err}
+	}()
+	select {
+	case <-s.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the request did not reach the server")
+	}
+	return result
+}
+
+// terminate sends SIGTERM to the test process, which ServeUntilSignal catches
+func terminate(t *testing.T) {
+	t.Helper()
+	self, err := os.FindProcess(os.Getpid())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := self.Signal(syscall.SIGTERM); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServeUntilSignalDrains(t *testing.T) {
+	s := newSlowServer(t)
+	status := make(chan int, 1)
+	hooked := make(chan struct{})
+	go func() {
+		status <- ServeUntilSignal(s.server, s.listener, 5*time.Second, func() error {
+			// consul deregistration happens while the proxy still takes connections
+			conn, err := net.Dial("tcp", s.listener.Addr().String())
+			if err != nil {
+				t.Errorf("connection refused before the shutdown steps ran: %s", err)
+			} else {
+				conn.Close()
+			}
+			close(hooked)
+			return nil
+		})
+	}()
+	// ServeUntilSignal listens for signals before it serves
+	inFlight := s.get(t)
+	terminate(t)
+	select {
+	case <-hooked:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the shutdown steps did not run")
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		conn, err := net.Dial("tcp", s.listener.Addr().String())
+		if err != nil {
+			break
+		}
+		conn.Close()
+		if time.Now().After(deadline) {
+			t.Fatal("new connections are still accepted while draining")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	select {
+	case code := <-status:
+		t.Fatalf("exited with status %d before the active request finished", code)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(s.release)
+	if r := <-inFlight; r.err != nil || r.body != "done" {
+		t.Fatalf("active request got %q, %v", r.body, r.err)
+	}
+	if code := <-status; code != 0 {
+		t.Fatalf("exit status %d, want 0", code)
+	}
+}
+
+func TestServeUntilSignalCutsRequests(t *testing.T) {
+	s := newSlowServer(t)
+	status := make(chan int, 1)
+	go func() {
+		// a failing step does not stop the shutdown
+		status <- ServeUntilSignal(s.server, s.listener, 100*time.Millisecond, func() error {
+			return errors.New("consul is away")
+		})
+	}()
+	inFlight := s.get(t)
+	terminate(t)
+	select {
+	case code := <-status:
+		if code != 1 {
+			t.Fatalf("exit status %d, want 1", code)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the drain timeout was not enforced")
+	}
+	if r := <-inFlight; r.err == nil {
+		t.Fatalf("the request that was cut got %q", r.body)
+	}
+}
+
+func TestServeUntilSignalServeFails(t *testing.T) {
+	s := newSlowServer(t)
+	s.listener.Close()
+	if code := ServeUntilSignal(s.server, s.listener, time.Second); code != 1 {
+		t.Fatalf("exit status %d, want 1", code)
+	}
+}
@@ -0,0 +1,127 @@
+package spnegoproxy
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/matchaxnb/gokrb5/v8/client"
+	"github.com/matchaxnb/gokrb5/v8/spnego"
+)
+
+// SPNEGO clients not used for that long are dropped from the registry
+const SPN_CLIENT_IDLE_TTL = time.Hour * 1
+
+// SPNEGOClientRegistry lazily builds one SPNEGOClient per SPN, all of them sharing
+// the TGT of a single Kerberos client
+type SPNEGOClientRegistry struct {
+	mu          sync.Mutex
+	krbClient   *client.Client
+	serviceType string
+	mutualAuth  bool
+	delegator   *s4uDelegator
+	idleTTL     time.Duration
+	lastSweep   time.Time
+	entries     map[string]*spnRegistryEntry
+}
+
+type spnRegistryEntry struct {
+	client   *SPNEGOClient
+	lastUsed time.Time
+}
+
+func NewSPNEGOClientRegistry(krbClient *client.Client, serviceType string) *SPNEGOClientRegistry {
+	r := &SPNEGOClientRegistry{
+		krbClient:   krbClient,
+		serviceType: serviceType,
+		idleTTL:     SPN_CLIENT_IDLE_TTL,
+		lastSweep:   time.Now(),
+		entries:     make(map[string]*spnRegistryEntry),
+	}
+	registerMetricsSource(r.metrics)
+	return r
+}
+
+// SPNForHost builds the SPN of the service running on host, e.g. HTTP/host
+func (r *SPNEGOClientRegistry) SPNForHost(host string) string {
+	return fmt.Sprintf("%s/%s", r.serviceType, host)
+}
+
+// ForHost returns the SPNEGO client for the service running on host
+func (r *SPNEGOClientRegistry) ForHost(host string) *SPNEGOClient {
+	return r.ForSPN(r.SPNForHost(host))
+}
+
+// ForSPN returns the cached SPNEGO client for spn, creating it if needed
+func (r *SPNEGOClientRegistry) ForSPN(spn string) *SPNEGOClient {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	if now.Sub(r.lastSweep) > r.idleTTL/2 {
+		r.sweep(now)
+	}
+	e, ok := r.entries[spn]
+	if !ok {
+		logger.Printf("Creating SPNEGO client for %s", spn)
+		e = &spnRegistryEntry{client: &SPNEGOClient{
+			Client:     spnego.SPNEGOClient(r.krbClient, spn),
+			krbClient:  r.krbClient,
+			spn:        spn,
+			mutualAuth: r.mutualAuth,
+			delegator:  r.delegator,
+		}}
+		r.entries[spn] = e
+	}
+	e.lastUsed = now
+	return e.client
+}
+
+// SetKrbClient makes the registry use a new Kerberos client, dropping the SPNEGO clients built on the previous one
+func (r *SPNEGOClientRegistry) SetKrbClient(krbClient *client.Client) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.krbClient = krbClient
+	r.entries = make(map[string]*spnRegistryEntry)
+	if r.delegator != nil {
+		r.delegator.setKrbClient(krbClient)
+	}
+}
+
+// sweep drops the clients that have been idle for too long, r.mu must be held
+func (r *SPNEGOClientRegistry) sweep(now time.Time) {
+	r.lastSweep = now
+	for spn, e := range r.entries {
+		if now.Sub(e.lastUsed) > r.idleTTL {
+			logger.Printf("Dropping idle SPNEGO client for %s", spn)
+			delete(r.entries, spn)
+		}
+	}
+}
+
+func (r *SPNEGOClientRegistry) metrics() string {
+	r.mu.Lock()
+	spns := make([]string, 0, len(r.entries))
+	clients := make(map[string]*SPNEGOClient, len(r.entries))
+	for spn, e := range r.entries {
+		spns = append(spns, spn)
+		clients[spn] = e.client
+	}
+	r.mu.Unlock()
+	sort.Strings(spns)
+
+	var sb strings.Builder
+	sb.WriteString(fmt.Sprintf("spnego_clients_cached %d\n", len(spns)))
+	for _, spn := range spns {
+		c := clients[spn]
+		sb.WriteString(fmt.Sprintf("spnego_tokens_total{spn=%q} %d\n", spn, c.tokens.Load()))
+		sb.WriteString(fmt.Sprintf("spnego_token_errors_total{spn=%q} %d\n", spn, c.failures.Load()))
+		sb.WriteString(fmt.Sprintf("spnego_last_token_timestamp{spn=%q} %d\n", spn, c.lastToken.Load()))
+		if c.mutualAuth {
+			sb.WriteString(fmt.Sprintf("spnego_mutual_auth_total{spn=%q,result=\"ok\"} %d\n", spn, c.mutualOK.Load()))
+			sb.WriteString(fmt.Sprintf("spnego_mutual_auth_total{spn=%q,result=\"failed\"} %d\n", spn, c.mutualFailed.Load()))
+		}
+	}
+	return sb.String()
+}
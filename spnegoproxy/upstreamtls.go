@@ -0,0 +1,50 @@
+package spnegoproxy
+
+import (
+	"crypto/tls"
+	"fmt"
+)
+
+// UpstreamTLSOptions configures TLS towards the backends, as for swebhdfs
+type UpstreamTLSOptions struct {
+	// PEM bundle of the CAs backend certificates are checked against, the system roots when empty
+	CAFile string
+	// client certificate and key presented to the backends (optional)
+	CertFile string
+	KeyFile  string
+	// do not check backend certificates at all, only good for labs
+	InsecureSkipVerify bool
+}
+
+// BuildUpstreamTLSConfig makes the TLS config used to talk to backends. The server name is left
+// empty so that each connection uses the FQDN of its backend for SNI and verification.
+func BuildUpstreamTLSConfig(opts UpstreamTLSOptions) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: opts.InsecureSkipVerify,
+	}
+	if opts.CAFile != "" {
+		pool, err := loadCertPool(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("cannot load upstream client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	if opts.InsecureSkipVerify {
+		logger.Print("Backend TLS certificates are NOT verified, do not do this in production")
+	}
+	return tlsConfig, nil
+}
+
+// SetUpstreamTLS makes the proxy talk HTTPS to the backends and to the DataNodes they redirect to
+func (h *ProxyHandler) SetUpstreamTLS(tlsConfig *tls.Config) {
+	h.upstreamScheme = "https"
+	h.upstream.TLSClientConfig = tlsConfig
+}
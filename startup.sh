@@ -1,6 +1,7 @@
 #!/bin/sh
 set -x
-/spnego-proxy \
+# exec so that the proxy gets SIGTERM and drains its connections
+exec /spnego-proxy \
   -addr "${LISTEN_ADDRESS}" \
   -metrics-addr "${METRICS_ADDRESS}" \
   -config "${KRB5_CONF}" \
@@ -9,7 +10,15 @@ set -x
   -consul-address "${CONSUL_ADDRESS}" \
   -proxy-service "${CONSUL_SERVICE_TO_PROXY}" \
   -spn-service-type "${SPN_SERVICE_TYPE}" \
+  -lb-strategy "${LB_STRATEGY}" \
+  -consul-service-id "${CONSUL_SERVICE_ID}" \
+  -consul-agent-address "${CONSUL_AGENT_ADDRESS}" \
+  -drain-timeout "${DRAIN_TIMEOUT}" \
+  -tls-cert "${TLS_CERT}" \
+  -tls-key "${TLS_KEY}" \
+  -tls-client-ca "${TLS_CLIENT_CA}" \
   -keytab-file "${KRB5_KEYTAB}" \
+  -password-file "${KRB5_PASSWORD_FILE}" \
   -proper-username "${PROPER_USERNAME}" \
   -drop-username "${DROP_USERNAME}" \
   -debug "${APP_DEBUG}"